@@ -2,12 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type mode int
@@ -26,18 +35,47 @@ type computer struct {
 	input  *intBuffer
 	output *intBuffer
 
+	// ctx bounds how long the input instruction waits for a value.
+	ctx context.Context
+
+	// metrics, if set, counts what the computer does.
+	metrics *machineMetrics
+
 	running bool
 }
 
 func (c *computer) runProgram() {
 	for c.running {
-		code, modes := parseOpcodeModes(c.next())
-		op, ok := opcodes[code]
-		if !ok {
-			panic(fmt.Sprintf("unknown opcode %d", code))
-		}
-		op(c, modes)
+		c.step()
+	}
+}
+
+func (c *computer) step() {
+	if c.metrics != nil {
+		c.metrics.instructions.Add(1)
+	}
+	code, modes := parseOpcodeModes(c.next())
+	op, ok := opcodes[code]
+	if !ok {
+		panic(fmt.Sprintf("unknown opcode %d", code))
 	}
+	op(c, modes)
+}
+
+// blocked reports whether the next instruction would wait: an input with
+// nothing to read, or an output with no room to write.
+func (c *computer) blocked() bool {
+	if !c.running {
+		return false
+	}
+	c.expandMemoryForIndex(c.pc)
+	switch code, _ := parseOpcodeModes(c.memory[c.pc]); code {
+	case 3:
+		return c.input.Len() == 0
+	case 4:
+		return c.output.Full()
+	}
+	return false
 }
 
 func parseOpcodeModes(value int) (code int, modes []mode) {
@@ -64,6 +102,7 @@ func newComputer(prg []int, input, output *intBuffer) *computer {
 		memory:  append([]int{}, prg...),
 		input:   input,
 		output:  output,
+		ctx:     context.Background(),
 		running: true,
 	}
 }
@@ -126,13 +165,22 @@ func mul(c *computer, modes []mode) {
 
 func input(c *computer, modes []mode) {
 	modes = fillModes(modes, 1)
-	n, _ := c.input.ReadInt()
+	n, err := c.input.ReadIntContext(c.ctx)
+	if err != nil {
+		panic(fmt.Sprintf("reading input: %v", err))
+	}
 	c.write(n, modes[0])
+	if c.metrics != nil {
+		c.metrics.inputs.Add(1)
+	}
 }
 
 func output(c *computer, modes []mode) {
 	modes = fillModes(modes, 1)
 	c.output.WriteInt(c.read(modes[0]))
+	if c.metrics != nil {
+		c.metrics.outputs.Add(1)
+	}
 }
 
 func jit(c *computer, modes []mode) {
@@ -199,45 +247,288 @@ var opcodes map[int]opcode = map[int]opcode{
 	99: halt,
 }
 
+// A scheduler runs computers round-robin on a single goroutine. Each takes
+// up to slice instructions in turn, and blocked computers are skipped until
+// someone writes to their input or reads their output.
+type scheduler struct {
+	machines []*computer
+	slice    int
+	// idle, if set, is called when every computer that's still running is
+	// blocked, to give it the chance to provide input or consume output.
+	idle func() error
+	// ctx, if set, ends the run with its error once it's done, and is what
+	// the computers wait for input with.
+	ctx context.Context
+}
+
+const defaultSlice = 1000
+
+var errDeadlock = errors.New("every machine is blocked")
+
+func (s *scheduler) run() error {
+	if s.ctx != nil {
+		for _, c := range s.machines {
+			c.ctx = s.ctx
+		}
+	}
+	for {
+		if s.ctx != nil && s.ctx.Err() != nil {
+			return s.ctx.Err()
+		}
+		running, progressed := 0, false
+		for _, c := range s.machines {
+			for i := 0; i < s.slice && c.running && !c.blocked(); i++ {
+				c.step()
+				progressed = true
+			}
+			if c.running {
+				running++
+			}
+		}
+		if running == 0 {
+			return nil
+		}
+		if progressed {
+			continue
+		}
+		if s.idle != nil {
+			if err := s.idle(); err != nil {
+				return err
+			}
+		}
+		if !s.ready() {
+			return fmt.Errorf("%w: %d still running", errDeadlock, running)
+		}
+	}
+}
+
+// ready reports whether any computer can run.
+func (s *scheduler) ready() bool {
+	for _, c := range s.machines {
+		if c.running && !c.blocked() {
+			return true
+		}
+	}
+	return false
+}
+
+var errBufferClosed = errors.New("buffer is closed")
+
+// An intBuffer is a queue of ints between a computer and whatever feeds it
+// or reads its output. If it has a capacity, writers wait while it's full;
+// a capacity of zero means it's unbounded. Once it's closed, reads return
+// what's left and then io.EOF.
 type intBuffer struct {
-	wait   *sync.Cond
-	ints   []int
-	closed bool
+	wait      *sync.Cond
+	ints      []int
+	capacity  int
+	closed    bool
+	observers []intObserver
+}
+
+// An intObserver is told about every value written to a buffer it's teed
+// from, and when the buffer is closed. An *intBuffer is an intObserver.
+type intObserver interface {
+	WriteInt(n int)
+	Close()
 }
 
 func newIntBuffer() *intBuffer {
+	return newBoundedIntBuffer(0)
+}
+
+func newBoundedIntBuffer(capacity int) *intBuffer {
 	var mu sync.Mutex
 	return &intBuffer{
-		wait: sync.NewCond(&mu),
+		wait:     sync.NewCond(&mu),
+		capacity: capacity,
 	}
 }
 
-func (rw *intBuffer) ReadInt() (int, bool) {
+// ReadInt removes and returns the next value, waiting until there is one.
+func (rw *intBuffer) ReadInt() (int, error) {
+	return rw.ReadIntContext(context.Background())
+}
+
+// ReadIntContext is like ReadInt, but gives up with the context's error
+// once it's done.
+func (rw *intBuffer) ReadIntContext(ctx context.Context) (int, error) {
+	if ctx.Done() != nil {
+		// Waiting on the condition can't also wait on the context, so wake
+		// every waiter when it's done.
+		stop := context.AfterFunc(ctx, func() {
+			rw.wait.L.Lock()
+			rw.wait.Broadcast()
+			rw.wait.L.Unlock()
+		})
+		defer stop()
+	}
 	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
 	for len(rw.ints) == 0 && !rw.closed {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		rw.wait.Wait()
 	}
-	if rw.closed && len(rw.ints) == 0 {
-		return 0, false
+	if len(rw.ints) == 0 {
+		return 0, io.EOF
 	}
 	n := rw.ints[0]
 	rw.ints = rw.ints[1:]
-	rw.wait.L.Unlock()
-	return n, true
+	rw.wait.Broadcast()
+	return n, nil
 }
 
+// WriteInt adds a value, waiting while the buffer is full. It panics if
+// the buffer is closed, like sending on a closed channel.
 func (rw *intBuffer) WriteInt(n int) {
 	rw.wait.L.Lock()
+	for rw.isFull() && !rw.closed {
+		rw.wait.Wait()
+	}
+	if rw.closed {
+		rw.wait.L.Unlock()
+		panic(errBufferClosed)
+	}
 	rw.ints = append(rw.ints, n)
+	observers := rw.observers
 	rw.wait.Broadcast()
 	rw.wait.L.Unlock()
+	for _, o := range observers {
+		o.WriteInt(n)
+	}
+}
+
+func (rw *intBuffer) isFull() bool {
+	return rw.capacity > 0 && len(rw.ints) >= rw.capacity
+}
+
+// Full reports whether a write would wait.
+func (rw *intBuffer) Full() bool {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	return rw.isFull() && !rw.closed
+}
+
+// Len returns the number of values waiting to be read.
+func (rw *intBuffer) Len() int {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	return len(rw.ints)
+}
+
+// Drain removes and returns everything currently in the buffer.
+func (rw *intBuffer) Drain() []int {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	ints := rw.ints
+	rw.ints = nil
+	rw.wait.Broadcast()
+	return ints
 }
 
+// Close marks the end of the values. Readers get io.EOF once they've read
+// everything already written, and waiting writers panic.
 func (rw *intBuffer) Close() {
 	rw.wait.L.Lock()
+	if rw.closed {
+		rw.wait.L.Unlock()
+		return
+	}
 	rw.closed = true
+	observers := rw.observers
 	rw.wait.Broadcast()
 	rw.wait.L.Unlock()
+	for _, o := range observers {
+		o.Close()
+	}
+}
+
+// Tee passes every value written to the buffer from now on to each of the
+// observers, after it's been added to the buffer and without affecting
+// what's read from it. Observers are called on the writer's goroutine, so
+// a full observer buffer holds up the writer.
+func (rw *intBuffer) Tee(observers ...intObserver) {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	rw.observers = append(append([]intObserver{}, rw.observers...), observers...)
+}
+
+// An intLogger is an intObserver that writes each value to w on its own
+// line, after prefix.
+type intLogger struct {
+	w      io.Writer
+	prefix string
+}
+
+func (l *intLogger) WriteInt(n int) { fmt.Fprintf(l.w, "%s%d\n", l.prefix, n) }
+func (l *intLogger) Close()         { fmt.Fprintf(l.w, "%sclosed\n", l.prefix) }
+
+// errTruncatedFrame is returned when a computer's output is closed partway
+// through a frame.
+var errTruncatedFrame = errors.New("output closed mid-frame")
+
+// A framer groups the values a computer outputs into frames. Frames are
+// size values long unless sizeOf is set, in which case the first value of
+// each frame is a tag and sizeOf returns the length of a frame with that tag.
+type framer struct {
+	src    *intBuffer
+	size   int
+	sizeOf func(tag int) int
+}
+
+// next returns the next frame, or io.EOF if the output was closed between
+// frames.
+func (f *framer) next() ([]int, error) {
+	n, err := f.src.ReadInt()
+	if err != nil {
+		return nil, err
+	}
+	size := f.size
+	if f.sizeOf != nil {
+		size = f.sizeOf(n)
+	}
+	frame := make([]int, 1, size)
+	frame[0] = n
+	for len(frame) < size {
+		n, err := f.src.ReadInt()
+		if err == io.EOF {
+			return frame, errTruncatedFrame
+		}
+		if err != nil {
+			return frame, err
+		}
+		frame = append(frame, n)
+	}
+	return frame, nil
+}
+
+// each calls fn with each frame until the output is closed.
+func (f *framer) each(fn func(frame []int)) error {
+	for {
+		frame, err := f.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: got %v", err, frame)
+		}
+		fn(frame)
+	}
+}
+
+// available calls fn with each complete frame that has already been output
+// without waiting for more. It only supports fixed size frames.
+func (f *framer) available(fn func(frame []int)) error {
+	for f.src.Len() >= f.size {
+		frame, err := f.next()
+		if err != nil {
+			return err
+		}
+		fn(frame)
+	}
+	return nil
 }
 
 type direction int
@@ -258,8 +549,7 @@ type robot struct {
 	c      *computer
 	input  *intBuffer
 	output *intBuffer
-
-	wg sync.WaitGroup
+	frames *framer
 
 	x    int
 	y    int
@@ -275,78 +565,95 @@ func newRobot(prg []int) *robot {
 		grid:   make(map[point]int),
 	}
 	r.c = newComputer(prg, r.input, r.output)
+	r.frames = &framer{src: r.output, size: 2}
 	return r
 }
 
-func (r *robot) run() {
+func (r *robot) run(ctx context.Context) error {
 	r.input.WriteInt(1)
-	r.wg.Add(1)
-	go r.handleIO()
-	r.c.runProgram()
+	s := &scheduler{
+		machines: []*computer{r.c},
+		slice:    defaultSlice,
+		ctx:      ctx,
+		idle:     r.handleIO,
+	}
+	if err := s.run(); err != nil {
+		return err
+	}
 	r.output.Close()
-	r.wg.Wait()
+	if err := r.frames.each(r.update); err != nil {
+		return err
+	}
 	r.drawGrid()
+	return nil
 }
 
-func (r *robot) handleIO() {
-	defer r.wg.Done()
-	for {
-		color, ok := r.output.ReadInt()
-		if !ok {
-			break
-		}
-		rot, ok := r.output.ReadInt()
-		if !ok {
-			break
-		}
+// A paintCommand is the frame the robot's program outputs each time it
+// reads the color under the robot.
+type paintCommand struct {
+	color int
+	turn  int
+}
 
-		if color != 0 && color != 1 {
-			panic(fmt.Sprintf("unexpected color %d", color))
-		}
-		if rot != 0 && rot != 1 {
-			panic(fmt.Sprintf("unexpected rotation %d", rot))
-		}
+// handleIO is called when the program is waiting for input. Each paint
+// command it has output moves the robot, which then reports the color under
+// it.
+func (r *robot) handleIO() error {
+	return r.frames.available(r.update)
+}
+
+func (r *robot) update(frame []int) {
+	r.paint(paintCommand{color: frame[0], turn: frame[1]})
+}
 
-		r.grid[point{r.x, r.y}] = color
+func (r *robot) paint(cmd paintCommand) {
+	color, rot := cmd.color, cmd.turn
+	if color != 0 && color != 1 {
+		panic(fmt.Sprintf("unexpected color %d", color))
+	}
+	if rot != 0 && rot != 1 {
+		panic(fmt.Sprintf("unexpected rotation %d", rot))
+	}
 
-		switch r.dir {
-		case up:
-			if rot == 0 {
-				r.dir = left
-				r.x--
-			} else {
-				r.dir = right
-				r.x++
-			}
-		case down:
-			if rot == 0 {
-				r.dir = right
-				r.x++
-			} else {
-				r.dir = left
-				r.x--
-			}
-		case left:
-			if rot == 0 {
-				r.dir = down
-				r.y++
-			} else {
-				r.dir = up
-				r.y--
-			}
-		case right:
-			if rot == 0 {
-				r.dir = up
-				r.y--
-			} else {
-				r.dir = down
-				r.y++
-			}
-		default:
-			panic(fmt.Sprintf("unexpected direction %d", r.dir))
+	r.grid[point{r.x, r.y}] = color
+
+	switch r.dir {
+	case up:
+		if rot == 0 {
+			r.dir = left
+			r.x--
+		} else {
+			r.dir = right
+			r.x++
+		}
+	case down:
+		if rot == 0 {
+			r.dir = right
+			r.x++
+		} else {
+			r.dir = left
+			r.x--
+		}
+	case left:
+		if rot == 0 {
+			r.dir = down
+			r.y++
+		} else {
+			r.dir = up
+			r.y--
 		}
-		r.input.WriteInt(r.grid[point{r.x, r.y}])
+	case right:
+		if rot == 0 {
+			r.dir = up
+			r.y--
+		} else {
+			r.dir = down
+			r.y++
+		}
+	default:
+		panic(fmt.Sprintf("unexpected direction %d", r.dir))
 	}
+	r.input.WriteInt(r.grid[point{r.x, r.y}])
 }
 
 func (r *robot) drawGrid() {
@@ -405,6 +712,67 @@ func (r *robot) drawGrid() {
 	}
 }
 
+// machineVars holds the metrics of every published computer, keyed by
+// name. -metrics serves them as JSON on /debug/vars.
+var machineVars = expvar.NewMap("intcode_machines")
+
+// machineMetrics counts what a computer has done. Computers published
+// under the same name share their metrics, so the counts add up over every
+// run. They're updated on the computer's goroutine and can be read from any
+// other.
+type machineMetrics struct {
+	instructions atomic.Int64
+	inputs       atomic.Int64
+	outputs      atomic.Int64
+}
+
+// metricsMu serializes looking up and publishing metrics.
+var metricsMu sync.Mutex
+
+// publishedMetrics returns the metrics published as name, publishing new
+// ones if there aren't any yet.
+func publishedMetrics(name string) *machineMetrics {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if m, ok := machineVars.Get(name).(*machineMetrics); ok {
+		return m
+	}
+	m := new(machineMetrics)
+	machineVars.Set(name, m)
+	return m
+}
+
+// String implements expvar.Var.
+func (m *machineMetrics) String() string {
+	return fmt.Sprintf(`{"instructions": %d, "inputs": %d, "outputs": %d}`,
+		m.instructions.Load(), m.inputs.Load(), m.outputs.Load())
+}
+
+// serveMetrics serves the published metrics on http://addr/debug/vars in
+// the background. addr has to be a localhost address.
+func serveMetrics(addr string) error {
+	if host, _, err := net.SplitHostPort(addr); err == nil && !isLoopback(host) {
+		return errors.New("-metrics must be a localhost address")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving metrics on http://%s/debug/vars", l.Addr())
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go http.Serve(l, mux)
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func loadProgram(filename string) ([]int, error) {
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -422,13 +790,35 @@ func loadProgram(filename string) ([]int, error) {
 }
 
 func run() error {
+	logIO := flag.Bool("log", false, "log the program's input and output to stderr")
+	timeout := flag.Duration("timeout", 0, "give up after this long, if positive")
+	metricsAddr := flag.String("metrics", "", "localhost address to serve each computer's metrics on")
+	flag.Parse()
+	if *metricsAddr != "" {
+		if err := serveMetrics(*metricsAddr); err != nil {
+			return err
+		}
+	}
+
 	prg, err := loadProgram("input.txt")
 	if err != nil {
 		return err
 	}
 	r := newRobot(prg)
-	r.run()
-	return nil
+	if *metricsAddr != "" {
+		r.c.metrics = publishedMetrics("robot")
+	}
+	if *logIO {
+		r.input.Tee(&intLogger{w: os.Stderr, prefix: "in "})
+		r.output.Tee(&intLogger{w: os.Stderr, prefix: "out "})
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	return r.run(ctx)
 }
 
 func main() {
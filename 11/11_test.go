@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"aoc2019/intcode/conformance"
+)
+
+func conformanceRun(prg, input []int) (output, memory []int, err error) {
+	c := newComputer(prg, newIntBuffer(), newIntBuffer())
+	for _, n := range input {
+		c.input.WriteInt(n)
+	}
+	c.input.Close()
+	c.runProgram()
+	return c.output.Drain(), c.memory, nil
+}
+
+// TestConformance runs the spec programs up to day 9, the last day whose
+// instructions this computer implements.
+func TestConformance(t *testing.T) {
+	conformance.Test(t, 9, conformanceRun)
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 type mode int
@@ -27,18 +36,62 @@ type computer struct {
 	input  *intBuffer
 	output *intBuffer
 
+	// inputFunc, if set, is called by the scheduler to provide each value
+	// the program reads when there's nothing to read from input.
+	inputFunc func() (int, error)
+
+	// ctx bounds how long the input instruction waits for a value.
+	ctx context.Context
+
+	// metrics, if set, counts what the computer does.
+	metrics *machineMetrics
+
 	running bool
 }
 
 func (c *computer) runProgram() {
 	for c.running {
-		code, modes := parseOpcodeModes(c.next())
-		op, ok := opcodes[code]
-		if !ok {
-			panic(fmt.Sprintf("unknown opcode %d", code))
-		}
-		op(c, modes)
+		c.step()
+	}
+}
+
+func (c *computer) step() {
+	if c.metrics != nil {
+		c.metrics.instructions.Add(1)
+	}
+	code, modes := parseOpcodeModes(c.next())
+	op, ok := opcodes[code]
+	if !ok {
+		panic(fmt.Sprintf("unknown opcode %d", code))
+	}
+	op(c, modes)
+}
+
+// blocked reports whether the next instruction would wait: an input with
+// nothing to read, or an output with no room to write.
+func (c *computer) blocked() bool {
+	if !c.running {
+		return false
+	}
+	c.expandMemoryForIndex(c.pc)
+	switch code, _ := parseOpcodeModes(c.memory[c.pc]); code {
+	case 3:
+		return c.input.Len() == 0
+	case 4:
+		return c.output.Full()
 	}
+	return false
+}
+
+// waitingForInput reports whether the next instruction is an input with
+// nothing to read.
+func (c *computer) waitingForInput() bool {
+	if !c.running {
+		return false
+	}
+	c.expandMemoryForIndex(c.pc)
+	code, _ := parseOpcodeModes(c.memory[c.pc])
+	return code == 3 && c.input.Len() == 0
 }
 
 func parseOpcodeModes(value int) (code int, modes []mode) {
@@ -65,6 +118,7 @@ func newComputer(prg []int, input, output *intBuffer) *computer {
 		memory:  append([]int{}, prg...),
 		input:   input,
 		output:  output,
+		ctx:     context.Background(),
 		running: true,
 	}
 }
@@ -127,13 +181,22 @@ func mul(c *computer, modes []mode) {
 
 func input(c *computer, modes []mode) {
 	modes = fillModes(modes, 1)
-	n := c.input.ReadInt()
+	n, err := c.input.ReadIntContext(c.ctx)
+	if err != nil {
+		panic(fmt.Sprintf("reading input: %v", err))
+	}
 	c.write(n, modes[0])
+	if c.metrics != nil {
+		c.metrics.inputs.Add(1)
+	}
 }
 
 func output(c *computer, modes []mode) {
 	modes = fillModes(modes, 1)
 	c.output.WriteInt(c.read(modes[0]))
+	if c.metrics != nil {
+		c.metrics.outputs.Add(1)
+	}
 }
 
 func jit(c *computer, modes []mode) {
@@ -200,71 +263,307 @@ var opcodes map[int]opcode = map[int]opcode{
 	99: halt,
 }
 
+// A scheduler runs computers round-robin on a single goroutine. Each takes
+// up to slice instructions in turn, and blocked computers are skipped until
+// someone writes to their input or reads their output.
+type scheduler struct {
+	machines []*computer
+	slice    int
+	// idle, if set, is called when every computer that's still running is
+	// blocked, to give it the chance to provide input or consume output.
+	idle func() error
+	// ctx, if set, ends the run with its error once it's done, and is what
+	// the computers wait for input with.
+	ctx context.Context
+}
+
+const defaultSlice = 1000
+
+var errDeadlock = errors.New("every machine is blocked")
+
+func (s *scheduler) run() error {
+	if s.ctx != nil {
+		for _, c := range s.machines {
+			c.ctx = s.ctx
+		}
+	}
+	for {
+		if s.ctx != nil && s.ctx.Err() != nil {
+			return s.ctx.Err()
+		}
+		running, progressed := 0, false
+		for _, c := range s.machines {
+			for i := 0; i < s.slice && c.running && !c.blocked(); i++ {
+				c.step()
+				progressed = true
+			}
+			if c.running {
+				running++
+			}
+		}
+		if running == 0 {
+			return nil
+		}
+		if progressed {
+			continue
+		}
+		if s.idle != nil {
+			if err := s.idle(); err != nil {
+				return err
+			}
+		}
+		if err := s.provideInput(); err != nil {
+			return err
+		}
+		if !s.ready() {
+			return fmt.Errorf("%w: %d still running", errDeadlock, running)
+		}
+	}
+}
+
+// provideInput gives each computer that's waiting for input and has an
+// inputFunc the value it returns, stopping at the first error.
+func (s *scheduler) provideInput() error {
+	for _, c := range s.machines {
+		if c.inputFunc != nil && c.waitingForInput() {
+			n, err := c.inputFunc()
+			if err != nil {
+				return err
+			}
+			c.input.WriteInt(n)
+		}
+	}
+	return nil
+}
+
+// ready reports whether any computer can run.
+func (s *scheduler) ready() bool {
+	for _, c := range s.machines {
+		if c.running && !c.blocked() {
+			return true
+		}
+	}
+	return false
+}
+
+var errBufferClosed = errors.New("buffer is closed")
+
+// An intBuffer is a queue of ints between a computer and whatever feeds it
+// or reads its output. If it has a capacity, writers wait while it's full;
+// a capacity of zero means it's unbounded. Once it's closed, reads return
+// what's left and then io.EOF.
 type intBuffer struct {
-	wait *sync.Cond
-	ints []int
+	wait     *sync.Cond
+	ints     []int
+	capacity int
+	closed   bool
 }
 
 func newIntBuffer() *intBuffer {
+	return newBoundedIntBuffer(0)
+}
+
+func newBoundedIntBuffer(capacity int) *intBuffer {
 	var mu sync.Mutex
 	return &intBuffer{
-		wait: sync.NewCond(&mu),
+		wait:     sync.NewCond(&mu),
+		capacity: capacity,
 	}
 }
 
-func (rw *intBuffer) ReadInt() int {
+// ReadInt removes and returns the next value, waiting until there is one.
+func (rw *intBuffer) ReadInt() (int, error) {
+	return rw.ReadIntContext(context.Background())
+}
+
+// ReadIntContext is like ReadInt, but gives up with the context's error
+// once it's done.
+func (rw *intBuffer) ReadIntContext(ctx context.Context) (int, error) {
+	if ctx.Done() != nil {
+		// Waiting on the condition can't also wait on the context, so wake
+		// every waiter when it's done.
+		stop := context.AfterFunc(ctx, func() {
+			rw.wait.L.Lock()
+			rw.wait.Broadcast()
+			rw.wait.L.Unlock()
+		})
+		defer stop()
+	}
 	rw.wait.L.Lock()
-	for len(rw.ints) == 0 {
+	defer rw.wait.L.Unlock()
+	for len(rw.ints) == 0 && !rw.closed {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		rw.wait.Wait()
 	}
+	if len(rw.ints) == 0 {
+		return 0, io.EOF
+	}
 	n := rw.ints[0]
 	rw.ints = rw.ints[1:]
-	rw.wait.L.Unlock()
-	return n
+	rw.wait.Broadcast()
+	return n, nil
 }
 
+// WriteInt adds a value, waiting while the buffer is full. It panics if
+// the buffer is closed, like sending on a closed channel.
 func (rw *intBuffer) WriteInt(n int) {
 	rw.wait.L.Lock()
+	for rw.isFull() && !rw.closed {
+		rw.wait.Wait()
+	}
+	if rw.closed {
+		rw.wait.L.Unlock()
+		panic(errBufferClosed)
+	}
 	rw.ints = append(rw.ints, n)
 	rw.wait.Broadcast()
 	rw.wait.L.Unlock()
 }
 
+func (rw *intBuffer) isFull() bool {
+	return rw.capacity > 0 && len(rw.ints) >= rw.capacity
+}
+
+// Full reports whether a write would wait.
+func (rw *intBuffer) Full() bool {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	return rw.isFull() && !rw.closed
+}
+
+// Len returns the number of values waiting to be read.
+func (rw *intBuffer) Len() int {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	return len(rw.ints)
+}
+
+// Drain removes and returns everything currently in the buffer.
+func (rw *intBuffer) Drain() []int {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	ints := rw.ints
+	rw.ints = nil
+	rw.wait.Broadcast()
+	return ints
+}
+
+// Close marks the end of the values. Readers get io.EOF once they've read
+// everything already written, and waiting writers panic.
+func (rw *intBuffer) Close() {
+	rw.wait.L.Lock()
+	if rw.closed {
+		rw.wait.L.Unlock()
+		return
+	}
+	rw.closed = true
+	rw.wait.Broadcast()
+	rw.wait.L.Unlock()
+}
+
+// errTruncatedFrame is returned when a computer's output is closed partway
+// through a frame.
+var errTruncatedFrame = errors.New("output closed mid-frame")
+
+// A framer groups the values a computer outputs into frames. Frames are
+// size values long unless sizeOf is set, in which case the first value of
+// each frame is a tag and sizeOf returns the length of a frame with that tag.
+type framer struct {
+	src    *intBuffer
+	size   int
+	sizeOf func(tag int) int
+}
+
+// next returns the next frame, or io.EOF if the output was closed between
+// frames.
+func (f *framer) next() ([]int, error) {
+	n, err := f.src.ReadInt()
+	if err != nil {
+		return nil, err
+	}
+	size := f.size
+	if f.sizeOf != nil {
+		size = f.sizeOf(n)
+	}
+	frame := make([]int, 1, size)
+	frame[0] = n
+	for len(frame) < size {
+		n, err := f.src.ReadInt()
+		if err == io.EOF {
+			return frame, errTruncatedFrame
+		}
+		if err != nil {
+			return frame, err
+		}
+		frame = append(frame, n)
+	}
+	return frame, nil
+}
+
+// each calls fn with each frame until the output is closed.
+func (f *framer) each(fn func(frame []int)) error {
+	for {
+		frame, err := f.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: got %v", err, frame)
+		}
+		fn(frame)
+	}
+}
+
+// available calls fn with each complete frame that has already been output
+// without waiting for more. It only supports fixed size frames.
+func (f *framer) available(fn func(frame []int)) error {
+	for f.src.Len() >= f.size {
+		frame, err := f.next()
+		if err != nil {
+			return err
+		}
+		fn(frame)
+	}
+	return nil
+}
+
 type arcade struct {
 	c      *computer
-	input  *intBuffer
 	output *intBuffer
+	frames *framer
 
-	mu     sync.Mutex
 	screen [][]rune
 	score  int
 }
 
 func newArcade(prg []int) *arcade {
-	prg[0] = 2
-	input := newIntBuffer()
 	output := newIntBuffer()
-	c := newComputer(prg, input, output)
 	a := &arcade{
-		c:      c,
-		input:  input,
+		c:      newComputer(prg, newIntBuffer(), output),
 		output: output,
+		frames: &framer{src: output, size: 3},
 	}
+	a.c.inputFunc = a.joystick
 	return a
 }
 
-func (a *arcade) run() {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		a.c.runProgram()
-		wg.Done()
-	}()
-	go a.handleInput()
-	go a.handleOutput()
-	go a.loopDrawScreen()
-	wg.Wait()
-	time.Sleep(5 * time.Second)
+func (a *arcade) run(ctx context.Context) error {
+	s := &scheduler{
+		machines: []*computer{a.c},
+		slice:    defaultSlice,
+		ctx:      ctx,
+	}
+	if err := s.run(); err != nil {
+		return err
+	}
+	a.output.Close()
+	if err := a.frames.each(a.update); err != nil {
+		return err
+	}
+	a.drawScreen()
+	return nil
 }
 
 var tileRunes = map[int]rune{
@@ -275,84 +574,284 @@ var tileRunes = map[int]rune{
 	4: 'o',
 }
 
-func (a *arcade) handleInput() {
-	for {
-		var ballX int
-		var paddleX int
-		a.mu.Lock()
-		for _, row := range a.screen {
-			for x, r := range row {
-				switch r {
-				case 'o':
-					ballX = x
-				case '-':
-					paddleX = x
-				}
+// joystick is the computer's inputFunc, called whenever the program reads
+// input. Everything the program has output by then is applied to the
+// screen before moving the paddle toward the ball.
+func (a *arcade) joystick() (int, error) {
+	if err := a.frames.available(a.update); err != nil {
+		return 0, err
+	}
+	a.drawScreen()
+
+	var ballX int
+	var paddleX int
+	for _, row := range a.screen {
+		for x, r := range row {
+			switch r {
+			case 'o':
+				ballX = x
+			case '-':
+				paddleX = x
 			}
 		}
-		a.mu.Unlock()
+	}
 
-		switch {
-		case paddleX < ballX:
-			a.input.WriteInt(1)
-		case paddleX > ballX:
-			a.input.WriteInt(-1)
-		default:
-			a.input.WriteInt(0)
-		}
-		time.Sleep(10 * time.Millisecond)
+	switch {
+	case paddleX < ballX:
+		return 1, nil
+	case paddleX > ballX:
+		return -1, nil
 	}
+	return 0, nil
 }
 
-func (a *arcade) handleOutput() {
-	for {
-		x := a.output.ReadInt()
-		y := a.output.ReadInt()
-		tile := a.output.ReadInt()
-
-		a.mu.Lock()
-		if y >= len(a.screen) {
-			screen := make([][]rune, y+1)
-			copy(screen, a.screen)
-			a.screen = screen
-		}
-		for i := 0; i < len(a.screen); i++ {
-			row := a.screen[i]
-			if x >= len(row) {
-				newRow := make([]rune, x+1)
-				copy(newRow, row)
-				a.screen[i] = newRow
-			}
-		}
+// A tileUpdate is the frame the arcade's program outputs to draw a tile, or
+// to set the score when x is -1 and y is 0.
+type tileUpdate struct {
+	x    int
+	y    int
+	tile int
+}
 
-		if x == -1 && y == 0 {
-			a.score = tile
-		} else {
-			r, ok := tileRunes[tile]
-			if !ok {
-				panic(fmt.Sprintf("unknown tile %d", tile))
-			}
-			a.screen[y][x] = r
+func (a *arcade) update(frame []int) {
+	a.updateTile(tileUpdate{x: frame[0], y: frame[1], tile: frame[2]})
+}
+
+func (a *arcade) updateTile(u tileUpdate) {
+	x, y, tile := u.x, u.y, u.tile
+	if y >= len(a.screen) {
+		screen := make([][]rune, y+1)
+		copy(screen, a.screen)
+		a.screen = screen
+	}
+	for i := 0; i < len(a.screen); i++ {
+		row := a.screen[i]
+		if x >= len(row) {
+			newRow := make([]rune, x+1)
+			copy(newRow, row)
+			a.screen[i] = newRow
 		}
-		a.mu.Unlock()
 	}
-}
 
-func (a *arcade) loopDrawScreen() {
-	for range time.Tick(100 * time.Millisecond) {
-		a.drawScreen()
-		fmt.Println(a.score)
+	if x == -1 && y == 0 {
+		a.score = tile
+	} else {
+		r, ok := tileRunes[tile]
+		if !ok {
+			panic(fmt.Sprintf("unknown tile %d", tile))
+		}
+		a.screen[y][x] = r
 	}
 }
 
 func (a *arcade) drawScreen() {
 	fmt.Print("\033[2J")
 	fmt.Print("\033[1;1H")
-	a.mu.Lock()
 	for _, row := range a.screen {
 		fmt.Println(string(row))
 	}
-	a.mu.Unlock()
+	fmt.Println(a.score)
+}
+
+// A patch sets every address from start to end, inclusive, to value before
+// a program runs.
+type patch struct {
+	line  int
+	start int
+	end   int
+	value int
+}
+
+// A patchFile holds patches that are always applied and named presets of
+// patches that are applied when selected. Each line of a patch file is
+// blank, a # comment, an address=value or start-end=value patch, or a
+// [name] header that starts a preset. Patches before the first header are
+// always applied.
+type patchFile struct {
+	always  []patch
+	presets map[string][]patch
+}
+
+func parsePatches(r io.Reader) (*patchFile, error) {
+	pf := &patchFile{presets: make(map[string][]patch)}
+	preset := ""
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+			preset = strings.TrimSpace(s[1 : len(s)-1])
+			if preset == "" {
+				return nil, fmt.Errorf("line %d: empty preset name", line)
+			}
+			pf.presets[preset] = nil
+			continue
+		}
+		p, err := parsePatch(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		p.line = line
+		if preset == "" {
+			pf.always = append(pf.always, p)
+		} else {
+			pf.presets[preset] = append(pf.presets[preset], p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+func parsePatch(s string) (patch, error) {
+	halves := strings.Split(s, "=")
+	if len(halves) != 2 {
+		return patch{}, fmt.Errorf("expected address=value, got %q", s)
+	}
+	var p patch
+	var err error
+	if p.value, err = strconv.Atoi(strings.TrimSpace(halves[1])); err != nil {
+		return patch{}, err
+	}
+	addrs := strings.TrimSpace(halves[0])
+	if addrs == "" {
+		return patch{}, fmt.Errorf("missing address in %q", s)
+	}
+	// Split on the dash between the addresses, not a leading minus sign.
+	if i := strings.Index(addrs[1:], "-"); i >= 0 {
+		if p.start, err = strconv.Atoi(strings.TrimSpace(addrs[:i+1])); err != nil {
+			return patch{}, err
+		}
+		if p.end, err = strconv.Atoi(strings.TrimSpace(addrs[i+2:])); err != nil {
+			return patch{}, err
+		}
+	} else {
+		if p.start, err = strconv.Atoi(addrs); err != nil {
+			return patch{}, err
+		}
+		p.end = p.start
+	}
+	if p.end < p.start {
+		return patch{}, fmt.Errorf("range %d-%d is backwards", p.start, p.end)
+	}
+	return p, nil
+}
+
+func loadPatches(filename string) (*patchFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePatches(f)
+}
+
+// merge adds the patches and presets in other to pf. Presets in other
+// replace presets of the same name.
+func (pf *patchFile) merge(other *patchFile) {
+	pf.always = append(pf.always, other.always...)
+	for name, patches := range other.presets {
+		pf.presets[name] = patches
+	}
+}
+
+// apply patches prg with the patches that are always applied followed by
+// the named presets, checking that every patched address exists.
+func (pf *patchFile) apply(prg []int, presets ...string) error {
+	patches := pf.always
+	for _, name := range presets {
+		ps, ok := pf.presets[name]
+		if !ok {
+			return fmt.Errorf("unknown preset %q", name)
+		}
+		patches = append(append([]patch{}, patches...), ps...)
+	}
+	for _, p := range patches {
+		if p.start < 0 || p.end >= len(prg) {
+			addrs := strconv.Itoa(p.start)
+			if p.end != p.start {
+				addrs += "-" + strconv.Itoa(p.end)
+			}
+			return fmt.Errorf("line %d: address %s is outside the %d cell program", p.line, addrs, len(prg))
+		}
+	}
+	for _, p := range patches {
+		for addr := p.start; addr <= p.end; addr++ {
+			prg[addr] = p.value
+		}
+	}
+	return nil
+}
+
+// builtinPatches are always available as presets.
+const builtinPatches = `
+# Two quarters, so the game can be played instead of watched.
+[freeplay]
+0=2
+`
+
+// machineVars holds the metrics of every published computer, keyed by
+// name. -metrics serves them as JSON on /debug/vars.
+var machineVars = expvar.NewMap("intcode_machines")
+
+// machineMetrics counts what a computer has done. Computers published
+// under the same name share their metrics, so the counts add up over every
+// run. They're updated on the computer's goroutine and can be read from any
+// other.
+type machineMetrics struct {
+	instructions atomic.Int64
+	inputs       atomic.Int64
+	outputs      atomic.Int64
+}
+
+// metricsMu serializes looking up and publishing metrics.
+var metricsMu sync.Mutex
+
+// publishedMetrics returns the metrics published as name, publishing new
+// ones if there aren't any yet.
+func publishedMetrics(name string) *machineMetrics {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if m, ok := machineVars.Get(name).(*machineMetrics); ok {
+		return m
+	}
+	m := new(machineMetrics)
+	machineVars.Set(name, m)
+	return m
+}
+
+// String implements expvar.Var.
+func (m *machineMetrics) String() string {
+	return fmt.Sprintf(`{"instructions": %d, "inputs": %d, "outputs": %d}`,
+		m.instructions.Load(), m.inputs.Load(), m.outputs.Load())
+}
+
+// serveMetrics serves the published metrics on http://addr/debug/vars in
+// the background. addr has to be a localhost address.
+func serveMetrics(addr string) error {
+	if host, _, err := net.SplitHostPort(addr); err == nil && !isLoopback(host) {
+		return errors.New("-metrics must be a localhost address")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving metrics on http://%s/debug/vars", l.Addr())
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go http.Serve(l, mux)
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func loadProgram(filename string) ([]int, error) {
@@ -372,13 +871,50 @@ func loadProgram(filename string) ([]int, error) {
 }
 
 func run() error {
+	patchFilename := flag.String("patch", "", "file of memory patches to apply before running")
+	preset := flag.String("preset", "freeplay", "named patch preset to apply, or empty for none")
+	timeout := flag.Duration("timeout", 0, "give up after this long, if positive")
+	metricsAddr := flag.String("metrics", "", "localhost address to serve each computer's metrics on")
+	flag.Parse()
+	if *metricsAddr != "" {
+		if err := serveMetrics(*metricsAddr); err != nil {
+			return err
+		}
+	}
+
 	prg, err := loadProgram("input.txt")
 	if err != nil {
 		return err
 	}
+	patches, err := parsePatches(strings.NewReader(builtinPatches))
+	if err != nil {
+		return err
+	}
+	if *patchFilename != "" {
+		pf, err := loadPatches(*patchFilename)
+		if err != nil {
+			return err
+		}
+		patches.merge(pf)
+	}
+	var presets []string
+	if *preset != "" {
+		presets = append(presets, *preset)
+	}
+	if err := patches.apply(prg, presets...); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
 	a := newArcade(prg)
-	a.run()
-	return nil
+	if *metricsAddr != "" {
+		a.c.metrics = publishedMetrics("arcade")
+	}
+	return a.run(ctx)
 }
 
 func main() {
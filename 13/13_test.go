@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"aoc2019/intcode/conformance"
+)
+
+func conformanceRun(prg, input []int) (output, memory []int, err error) {
+	c := newComputer(prg, newIntBuffer(), newIntBuffer())
+	for _, n := range input {
+		c.input.WriteInt(n)
+	}
+	c.input.Close()
+	c.runProgram()
+	return c.output.Drain(), c.memory, nil
+}
+
+// TestConformance runs the spec programs up to day 9, the last day whose
+// instructions this computer implements.
+func TestConformance(t *testing.T) {
+	conformance.Test(t, 9, conformanceRun)
+}
+
+func TestInputFuncError(t *testing.T) {
+	// in, out, halt
+	c := newComputer([]int{3, 5, 4, 5, 99, 0}, newIntBuffer(), newIntBuffer())
+	errJoystick := errors.New("joystick broke")
+	c.inputFunc = func() (int, error) { return 0, errJoystick }
+	s := &scheduler{machines: []*computer{c}, slice: defaultSlice}
+	if err := s.run(); !errors.Is(err, errJoystick) {
+		t.Errorf("run() = %v, want %v", err, errJoystick)
+	}
+}
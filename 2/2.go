@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
 	"strconv"
 	"strings"
 )
@@ -52,10 +56,16 @@ var opcodes map[int]opcode = map[int]opcode{
 }
 
 func tryWithInputs(prg []int, n, v int) int {
+	memory := append([]int{}, prg...)
+	memory[1] = n
+	memory[2] = v
+	return execute(memory)
+}
+
+// execute runs a program in memory and returns the value left at address 0.
+func execute(memory []int) int {
 	c := newComputer()
-	c.memory = append([]int{}, prg...)
-	c.memory[1] = n
-	c.memory[2] = v
+	c.memory = memory
 	for c.running {
 		op, ok := opcodes[c.next()]
 		if !ok {
@@ -66,6 +76,147 @@ func tryWithInputs(prg []int, n, v int) int {
 	return c.memory[0]
 }
 
+// A patch sets every address from start to end, inclusive, to value before
+// a program runs.
+type patch struct {
+	line  int
+	start int
+	end   int
+	value int
+}
+
+// A patchFile holds patches that are always applied and named presets of
+// patches that are applied when selected. Each line of a patch file is
+// blank, a # comment, an address=value or start-end=value patch, or a
+// [name] header that starts a preset. Patches before the first header are
+// always applied.
+type patchFile struct {
+	always  []patch
+	presets map[string][]patch
+}
+
+func parsePatches(r io.Reader) (*patchFile, error) {
+	pf := &patchFile{presets: make(map[string][]patch)}
+	preset := ""
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+			preset = strings.TrimSpace(s[1 : len(s)-1])
+			if preset == "" {
+				return nil, fmt.Errorf("line %d: empty preset name", line)
+			}
+			pf.presets[preset] = nil
+			continue
+		}
+		p, err := parsePatch(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		p.line = line
+		if preset == "" {
+			pf.always = append(pf.always, p)
+		} else {
+			pf.presets[preset] = append(pf.presets[preset], p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+func parsePatch(s string) (patch, error) {
+	halves := strings.Split(s, "=")
+	if len(halves) != 2 {
+		return patch{}, fmt.Errorf("expected address=value, got %q", s)
+	}
+	var p patch
+	var err error
+	if p.value, err = strconv.Atoi(strings.TrimSpace(halves[1])); err != nil {
+		return patch{}, err
+	}
+	addrs := strings.TrimSpace(halves[0])
+	if addrs == "" {
+		return patch{}, fmt.Errorf("missing address in %q", s)
+	}
+	// Split on the dash between the addresses, not a leading minus sign.
+	if i := strings.Index(addrs[1:], "-"); i >= 0 {
+		if p.start, err = strconv.Atoi(strings.TrimSpace(addrs[:i+1])); err != nil {
+			return patch{}, err
+		}
+		if p.end, err = strconv.Atoi(strings.TrimSpace(addrs[i+2:])); err != nil {
+			return patch{}, err
+		}
+	} else {
+		if p.start, err = strconv.Atoi(addrs); err != nil {
+			return patch{}, err
+		}
+		p.end = p.start
+	}
+	if p.end < p.start {
+		return patch{}, fmt.Errorf("range %d-%d is backwards", p.start, p.end)
+	}
+	return p, nil
+}
+
+func loadPatches(filename string) (*patchFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePatches(f)
+}
+
+// merge adds the patches and presets in other to pf. Presets in other
+// replace presets of the same name.
+func (pf *patchFile) merge(other *patchFile) {
+	pf.always = append(pf.always, other.always...)
+	for name, patches := range other.presets {
+		pf.presets[name] = patches
+	}
+}
+
+// apply patches prg with the patches that are always applied followed by
+// the named presets, checking that every patched address exists.
+func (pf *patchFile) apply(prg []int, presets ...string) error {
+	patches := pf.always
+	for _, name := range presets {
+		ps, ok := pf.presets[name]
+		if !ok {
+			return fmt.Errorf("unknown preset %q", name)
+		}
+		patches = append(append([]patch{}, patches...), ps...)
+	}
+	for _, p := range patches {
+		if p.start < 0 || p.end >= len(prg) {
+			addrs := strconv.Itoa(p.start)
+			if p.end != p.start {
+				addrs += "-" + strconv.Itoa(p.end)
+			}
+			return fmt.Errorf("line %d: address %s is outside the %d cell program", p.line, addrs, len(prg))
+		}
+	}
+	for _, p := range patches {
+		for addr := p.start; addr <= p.end; addr++ {
+			prg[addr] = p.value
+		}
+	}
+	return nil
+}
+
+// builtinPatches are always available as presets.
+const builtinPatches = `
+# The 1202 program alarm state from part one.
+[1202]
+1=12
+2=2
+`
+
 func loadProgram(filename string) ([]int, error) {
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -83,10 +234,41 @@ func loadProgram(filename string) ([]int, error) {
 }
 
 func run() error {
+	patchFilename := flag.String("patch", "", "file of memory patches to apply before running")
+	preset := flag.String("preset", "", "named patch preset to apply, e.g. 1202")
+	flag.Parse()
+
 	prg, err := loadProgram("input.txt")
 	if err != nil {
 		return err
 	}
+
+	// With patches, run the program once instead of searching for the noun
+	// and verb.
+	if *patchFilename != "" || *preset != "" {
+		patches, err := parsePatches(strings.NewReader(builtinPatches))
+		if err != nil {
+			return err
+		}
+		if *patchFilename != "" {
+			pf, err := loadPatches(*patchFilename)
+			if err != nil {
+				return err
+			}
+			patches.merge(pf)
+		}
+		var presets []string
+		if *preset != "" {
+			presets = append(presets, *preset)
+		}
+		memory := append([]int{}, prg...)
+		if err := patches.apply(memory, presets...); err != nil {
+			return err
+		}
+		fmt.Println(execute(memory))
+		return nil
+	}
+
 	target := 19690720
 	for n := 0; n < 100; n++ {
 		for v := 0; v < 100; v++ {
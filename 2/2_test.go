@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"aoc2019/intcode/conformance"
+)
+
+func conformanceRun(prg, input []int) (output, memory []int, err error) {
+	if len(input) > 0 {
+		return nil, nil, errors.New("this computer can't read input")
+	}
+	execute(prg)
+	return nil, prg, nil
+}
+
+// TestConformance runs the spec programs up to day 2, the last day whose
+// instructions this computer implements.
+func TestConformance(t *testing.T) {
+	conformance.Test(t, 2, conformanceRun)
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +12,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 type mode int
@@ -22,12 +26,36 @@ type computer struct {
 	pc     int
 	memory []int
 
-	input  io.Reader
+	// input holds the values left for the program to read.
+	input  []int
 	output io.Writer
 
+	// The address and value of the instruction being executed and the one
+	// executed before it.
+	instrPC int
+	instrOp int
+	prevPC  int
+	prevOp  int
+
+	diagnostics []diagnostic
+
 	running bool
 }
 
+func (c *computer) runProgram() {
+	for c.running {
+		c.prevPC, c.prevOp = c.instrPC, c.instrOp
+		c.instrPC = c.pc
+		c.instrOp = c.next()
+		code, modes := parseOpcodeModes(c.instrOp)
+		op, ok := opcodes[code]
+		if !ok {
+			panic(fmt.Sprintf("unknown opcode %d", code))
+		}
+		op(c, modes)
+	}
+}
+
 func parseOpcodeModes(value int) (code int, modes []mode) {
 	code = value % 100
 	value /= 100
@@ -47,7 +75,7 @@ func fillModes(modes []mode, size int) []mode {
 	return modes
 }
 
-func newComputer(prg []int, input io.Reader, output io.Writer) *computer {
+func newComputer(prg []int, input []int, output io.Writer) *computer {
 	return &computer{
 		memory:  prg,
 		input:   input,
@@ -94,20 +122,24 @@ func mul(c *computer, modes []mode) {
 
 func in(c *computer, modes []mode) {
 	modes = fillModes(modes, 1)
-	b, err := ioutil.ReadAll(c.input)
-	if err != nil {
-		panic(fmt.Sprintf("error reading input: %s", err))
-	}
-	n, err := strconv.Atoi(string(b))
-	if err != nil {
-		panic(fmt.Sprintf("error parsing input: %s", err))
+	if len(c.input) == 0 {
+		panic(fmt.Sprintf("error reading input: %s", io.EOF))
 	}
+	n := c.input[0]
+	c.input = c.input[1:]
 	c.write(n)
 }
 
 func out(c *computer, modes []mode) {
 	modes = fillModes(modes, 1)
-	s := strconv.Itoa(c.read(modes[0]))
+	n := c.read(modes[0])
+	c.diagnostics = append(c.diagnostics, diagnostic{
+		code:   n,
+		pc:     c.instrPC,
+		testPC: c.prevPC,
+		testOp: c.prevOp,
+	})
+	s := strconv.Itoa(n)
 	c.output.Write([]byte(s))
 	c.output.Write([]byte("\n"))
 }
@@ -170,6 +202,85 @@ var opcodes map[int]opcode = map[int]opcode{
 	99: halt,
 }
 
+var opcodeNames = map[int]string{
+	1:  "add",
+	2:  "mul",
+	3:  "in",
+	4:  "out",
+	5:  "jit",
+	6:  "jif",
+	7:  "lt",
+	8:  "eq",
+	99: "halt",
+}
+
+var opcodeParams = map[int]int{
+	1:  3,
+	2:  3,
+	3:  1,
+	4:  1,
+	5:  2,
+	6:  2,
+	7:  3,
+	8:  3,
+	99: 0,
+}
+
+// describeInstruction formats an instruction's opcode and parameter modes,
+// e.g. "mul [0 1 0]" for 1002.
+func describeInstruction(value int) string {
+	code, modes := parseOpcodeModes(value)
+	name, ok := opcodeNames[code]
+	if !ok {
+		return fmt.Sprintf("unknown opcode %d", value)
+	}
+	return fmt.Sprintf("%s %v", name, fillModes(modes, opcodeParams[code]))
+}
+
+// A diagnostic is a code output by the TEST program along with the
+// instruction that emitted it and the instruction executed just before,
+// which is the one the test exercised.
+type diagnostic struct {
+	code   int
+	pc     int
+	testPC int
+	testOp int
+}
+
+// checkDiagnostics verifies that every diagnostic code but the last, which
+// is the program's answer, is zero.
+func checkDiagnostics(diags []diagnostic) error {
+	if len(diags) == 0 {
+		return errors.New("no diagnostic codes were output")
+	}
+	var failures []string
+	for _, d := range diags[:len(diags)-1] {
+		if d.code != 0 {
+			failures = append(failures, fmt.Sprintf("output %d at pc %d after %s at pc %d",
+				d.code, d.pc, describeInstruction(d.testOp), d.testPC))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d diagnostic tests failed: %s",
+			len(failures), len(diags)-1, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func printReport(diags []diagnostic) {
+	for i, d := range diags {
+		status := "ok"
+		switch {
+		case i == len(diags)-1:
+			status = "result"
+		case d.code != 0:
+			status = "FAIL"
+		}
+		fmt.Printf("%-6s  code %-10d  out at pc %-4d  test %s at pc %d\n",
+			status, d.code, d.pc, describeInstruction(d.testOp), d.testPC)
+	}
+}
+
 func loadProgram(filename string) ([]int, error) {
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -186,19 +297,83 @@ func loadProgram(filename string) ([]int, error) {
 	return prg, nil
 }
 
+// parseInputs parses a comma or whitespace separated list of integers.
+func parseInputs(s string) ([]int, error) {
+	var ints []int
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// readInputs returns the values of an -input flag. "-" takes the next line
+// of stdin, so each -input - gets a line of its own.
+func readInputs(s string, stdin *bufio.Reader) ([]int, error) {
+	if s == "-" {
+		line, err := stdin.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, fmt.Errorf("reading stdin: %w", err)
+		}
+		s = line
+	}
+	return parseInputs(s)
+}
+
+// inputFlags collects each -input flag. The program is run once per flag.
+type inputFlags []string
+
+func (f *inputFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *inputFlags) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
 func run() error {
+	var inputs inputFlags
+	flag.Var(&inputs, "input", "comma or space separated program input, or - to read a line of stdin (repeatable)")
+	report := flag.Bool("report", false, "check diagnostic codes and report failing tests instead of printing outputs")
+	flag.Parse()
+	if len(inputs) == 0 {
+		inputs = inputFlags{"1", "5"}
+	}
+
 	prg, err := loadProgram("input.txt")
 	if err != nil {
 		return err
 	}
-	c := newComputer(prg, bytes.NewBufferString("5"), os.Stdout)
-	for c.running {
-		code, modes := parseOpcodeModes(c.next())
-		op, ok := opcodes[code]
-		if !ok {
-			panic(fmt.Sprintf("unknown opcode %d", code))
+	stdin := bufio.NewReader(os.Stdin)
+	var failed []string
+	for _, in := range inputs {
+		ints, err := readInputs(in, stdin)
+		if err != nil {
+			return fmt.Errorf("input %s: %w", in, err)
 		}
-		op(c, modes)
+		var w io.Writer = os.Stdout
+		if *report {
+			w = ioutil.Discard
+		}
+		fmt.Printf("input %s:\n", in)
+		c := newComputer(append([]int{}, prg...), ints, w)
+		c.runProgram()
+		if *report {
+			printReport(c.diagnostics)
+			if err := checkDiagnostics(c.diagnostics); err != nil {
+				failed = append(failed, fmt.Sprintf("input %s: %s", in, err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "\n"))
 	}
 	return nil
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"aoc2019/intcode/conformance"
+)
+
+func conformanceRun(prg, input []int) (output, memory []int, err error) {
+	var out bytes.Buffer
+	c := newComputer(prg, append([]int{}, input...), &out)
+	c.runProgram()
+	for _, line := range strings.Fields(out.String()) {
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, nil, err
+		}
+		output = append(output, n)
+	}
+	return output, c.memory, nil
+}
+
+// TestConformance runs the spec programs up to day 5, the last day whose
+// instructions this computer implements.
+func TestConformance(t *testing.T) {
+	conformance.Test(t, 5, conformanceRun)
+}
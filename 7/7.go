@@ -1,13 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/tabwriter"
 )
 
 type mode int
@@ -21,21 +34,53 @@ type computer struct {
 	pc     int
 	memory []int
 
-	input  *intBuffer
-	output *intBuffer
+	input  intPipe
+	output intPipe
+
+	// steps counts the instructions started, including the current one.
+	steps int
+
+	// ctx bounds how long the input instruction waits for a value.
+	ctx context.Context
+
+	// metrics, if set, counts what the computer does.
+	metrics *machineMetrics
 
 	running bool
 }
 
 func (c *computer) runProgram() {
 	for c.running {
-		code, modes := parseOpcodeModes(c.next())
-		op, ok := opcodes[code]
-		if !ok {
-			panic(fmt.Sprintf("unknown opcode %d", code))
-		}
-		op(c, modes)
+		c.step()
+	}
+}
+
+func (c *computer) step() {
+	if c.metrics != nil {
+		c.metrics.instructions.Add(1)
+	}
+	c.steps++
+	code, modes := parseOpcodeModes(c.next())
+	op, ok := opcodes[code]
+	if !ok {
+		panic(fmt.Sprintf("unknown opcode %d", code))
 	}
+	op(c, modes)
+}
+
+// blocked reports whether the next instruction would wait: an input with
+// nothing to read, or an output with no room to write.
+func (c *computer) blocked() bool {
+	if !c.running {
+		return false
+	}
+	switch code, _ := parseOpcodeModes(c.memory[c.pc]); code {
+	case 3:
+		return c.input.Len() == 0
+	case 4:
+		return c.output.Full()
+	}
+	return false
 }
 
 func parseOpcodeModes(value int) (code int, modes []mode) {
@@ -57,15 +102,42 @@ func fillModes(modes []mode, size int) []mode {
 	return modes
 }
 
-func newComputer(prg []int, input, output *intBuffer) *computer {
+func newComputer(prg []int, input, output intPipe) *computer {
 	return &computer{
 		memory:  append([]int{}, prg...),
 		input:   input,
 		output:  output,
+		ctx:     context.Background(),
 		running: true,
 	}
 }
 
+// A snapshot is the state of a computer, which it can be reset to.
+type snapshot struct {
+	pc      int
+	running bool
+	memory  []int
+}
+
+func (c *computer) snapshot() *snapshot {
+	return &snapshot{
+		pc:      c.pc,
+		running: c.running,
+		memory:  append([]int{}, c.memory...),
+	}
+}
+
+// reset puts the computer back in the state captured by s, reusing its
+// memory, and connects it to new pipes.
+func (c *computer) reset(s *snapshot, input, output intPipe) {
+	c.memory = append(c.memory[:0], s.memory...)
+	c.pc = s.pc
+	c.running = s.running
+	c.steps = 0
+	c.input = input
+	c.output = output
+}
+
 func (c *computer) next() int {
 	n := c.memory[c.pc]
 	c.pc++
@@ -104,13 +176,22 @@ func mul(c *computer, modes []mode) {
 
 func input(c *computer, modes []mode) {
 	modes = fillModes(modes, 1)
-	n := c.input.ReadInt()
+	n, err := c.input.ReadIntContext(c.ctx)
+	if err != nil {
+		panic(fmt.Sprintf("reading input: %v", err))
+	}
 	c.write(n)
+	if c.metrics != nil {
+		c.metrics.inputs.Add(1)
+	}
 }
 
 func output(c *computer, modes []mode) {
 	modes = fillModes(modes, 1)
 	c.output.WriteInt(c.read(modes[0]))
+	if c.metrics != nil {
+		c.metrics.outputs.Add(1)
+	}
 }
 
 func jit(c *computer, modes []mode) {
@@ -173,11 +254,11 @@ var opcodes map[int]opcode = map[int]opcode{
 
 type amplifier struct {
 	c      *computer
-	input  *intBuffer
-	output *intBuffer
+	input  intPipe
+	output intPipe
 }
 
-func newAmplifier(prg []int, phase int, input, output *intBuffer) *amplifier {
+func newAmplifier(prg []int, phase int, input, output intPipe) *amplifier {
 	c := newComputer(prg, input, output)
 	input.WriteInt(phase)
 	amp := &amplifier{
@@ -188,6 +269,14 @@ func newAmplifier(prg []int, phase int, input, output *intBuffer) *amplifier {
 	return amp
 }
 
+// reset starts the amplifier again from start with a new phase and pipes.
+func (a *amplifier) reset(start *snapshot, phase int, input, output intPipe) {
+	a.c.reset(start, input, output)
+	a.input = input
+	a.output = output
+	input.WriteInt(phase)
+}
+
 func (a *amplifier) addInput(in int) {
 	a.input.WriteInt(in)
 }
@@ -196,34 +285,421 @@ func (a *amplifier) runProgram() {
 	a.c.runProgram()
 }
 
-type intBuffer struct {
-	wait *sync.Cond
+// A scheduler runs computers round-robin on a single goroutine. Each takes
+// up to slice instructions in turn, and blocked computers are skipped until
+// someone writes to their input or reads their output.
+type scheduler struct {
+	machines []*computer
+	slice    int
+	// idle, if set, is called when every computer that's still running is
+	// blocked, to give it the chance to provide input or consume output.
+	idle func() error
+	// ctx, if set, ends the run with its error once it's done, and is what
+	// the computers wait for input with.
+	ctx context.Context
+	// halted, if set, is called when a computer halts.
+	halted func(c *computer)
+}
+
+const defaultSlice = 1000
+
+var errDeadlock = errors.New("every machine is blocked")
+
+func (s *scheduler) run() error {
+	if s.ctx != nil {
+		for _, c := range s.machines {
+			c.ctx = s.ctx
+		}
+	}
+	for {
+		if s.ctx != nil && s.ctx.Err() != nil {
+			return s.ctx.Err()
+		}
+		running, progressed := 0, false
+		for _, c := range s.machines {
+			wasRunning := c.running
+			for i := 0; i < s.slice && c.running && !c.blocked(); i++ {
+				c.step()
+				progressed = true
+			}
+			if c.running {
+				running++
+			} else if wasRunning && s.halted != nil {
+				s.halted(c)
+			}
+		}
+		if running == 0 {
+			return nil
+		}
+		if progressed {
+			continue
+		}
+		if s.idle != nil {
+			if err := s.idle(); err != nil {
+				return err
+			}
+		}
+		if !s.ready() {
+			return fmt.Errorf("%w: %d still running", errDeadlock, running)
+		}
+	}
+}
+
+// ready reports whether any computer can run.
+func (s *scheduler) ready() bool {
+	for _, c := range s.machines {
+		if c.running && !c.blocked() {
+			return true
+		}
+	}
+	return false
+}
+
+// An intPipe carries values from one computer to another. *intBuffer and
+// *ringBuffer are both intPipes.
+type intPipe interface {
+	ReadInt() (int, error)
+	ReadIntContext(ctx context.Context) (int, error)
+	WriteInt(n int)
+	Len() int
+	Full() bool
+	Close()
+}
+
+// A ringBuffer is a fixed-size intPipe for exactly one reader and one
+// writer, which synchronize through atomic indexes instead of a lock.
+// Readers and writers that have to wait spin, yielding the processor, so
+// it suits pipes between computers run by a scheduler, which don't wait.
+type ringBuffer struct {
 	ints []int
+	mask uint64
+	// head is the index of the next value to read and is only changed by
+	// the reader; tail is the index of the next value to write and is only
+	// changed by the writer. They're taken modulo len(ints).
+	head   atomic.Uint64
+	tail   atomic.Uint64
+	closed atomic.Bool
+}
+
+// newRingBuffer returns a ring buffer that holds at least capacity values.
+func newRingBuffer(capacity int) *ringBuffer {
+	size := 1
+	for size < capacity {
+		size <<= 1
+	}
+	return &ringBuffer{ints: make([]int, size), mask: uint64(size - 1)}
+}
+
+// ReadInt returns the next value, waiting until there is one. Once the
+// buffer is closed and empty it returns io.EOF.
+func (r *ringBuffer) ReadInt() (int, error) {
+	return r.ReadIntContext(context.Background())
+}
+
+// ReadIntContext is like ReadInt, but gives up with the context's error
+// once it's done.
+func (r *ringBuffer) ReadIntContext(ctx context.Context) (int, error) {
+	for {
+		head := r.head.Load()
+		if head != r.tail.Load() {
+			n := r.ints[head&r.mask]
+			r.head.Store(head + 1)
+			return n, nil
+		}
+		// Check for a value again after seeing the buffer closed, in case
+		// it was written just before.
+		if r.closed.Load() && head == r.tail.Load() {
+			return 0, io.EOF
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		runtime.Gosched()
+	}
+}
+
+// WriteInt adds n to the buffer, waiting while it's full. Writing to a
+// closed buffer panics.
+func (r *ringBuffer) WriteInt(n int) {
+	tail := r.tail.Load()
+	for tail-r.head.Load() == uint64(len(r.ints)) {
+		if r.closed.Load() {
+			break
+		}
+		runtime.Gosched()
+	}
+	if r.closed.Load() {
+		panic(errBufferClosed)
+	}
+	r.ints[tail&r.mask] = n
+	r.tail.Store(tail + 1)
+}
+
+func (r *ringBuffer) Len() int {
+	return int(r.tail.Load() - r.head.Load())
+}
+
+func (r *ringBuffer) Full() bool {
+	return r.Len() == len(r.ints)
+}
+
+// Close marks the end of the values. The reader gets io.EOF once it's read
+// everything already written.
+func (r *ringBuffer) Close() {
+	r.closed.Store(true)
+}
+
+var errBufferClosed = errors.New("buffer is closed")
+
+// An intBuffer is a queue of ints between a computer and whatever feeds it
+// or reads its output. If it has a capacity, writers wait while it's full;
+// a capacity of zero means it's unbounded. Once it's closed, reads return
+// what's left and then io.EOF.
+type intBuffer struct {
+	wait      *sync.Cond
+	ints      []int
+	capacity  int
+	closed    bool
+	observers []intObserver
+}
+
+// An intObserver is told about every value written to a buffer it's teed
+// from, and when the buffer is closed. An *intBuffer is an intObserver.
+type intObserver interface {
+	WriteInt(n int)
+	Close()
 }
 
 func newIntBuffer() *intBuffer {
+	return newBoundedIntBuffer(0)
+}
+
+func newBoundedIntBuffer(capacity int) *intBuffer {
 	var mu sync.Mutex
 	return &intBuffer{
-		wait: sync.NewCond(&mu),
+		wait:     sync.NewCond(&mu),
+		capacity: capacity,
 	}
 }
 
-func (rw *intBuffer) ReadInt() int {
+// ReadInt removes and returns the next value, waiting until there is one.
+func (rw *intBuffer) ReadInt() (int, error) {
+	return rw.ReadIntContext(context.Background())
+}
+
+// ReadIntContext is like ReadInt, but gives up with the context's error
+// once it's done.
+func (rw *intBuffer) ReadIntContext(ctx context.Context) (int, error) {
+	if ctx.Done() != nil {
+		// Waiting on the condition can't also wait on the context, so wake
+		// every waiter when it's done.
+		stop := context.AfterFunc(ctx, func() {
+			rw.wait.L.Lock()
+			rw.wait.Broadcast()
+			rw.wait.L.Unlock()
+		})
+		defer stop()
+	}
 	rw.wait.L.Lock()
-	for len(rw.ints) == 0 {
+	defer rw.wait.L.Unlock()
+	for len(rw.ints) == 0 && !rw.closed {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		rw.wait.Wait()
 	}
+	if len(rw.ints) == 0 {
+		return 0, io.EOF
+	}
 	n := rw.ints[0]
 	rw.ints = rw.ints[1:]
-	rw.wait.L.Unlock()
-	return n
+	rw.wait.Broadcast()
+	return n, nil
 }
 
+// WriteInt adds a value, waiting while the buffer is full. It panics if
+// the buffer is closed, like sending on a closed channel.
 func (rw *intBuffer) WriteInt(n int) {
 	rw.wait.L.Lock()
+	for rw.isFull() && !rw.closed {
+		rw.wait.Wait()
+	}
+	if rw.closed {
+		rw.wait.L.Unlock()
+		panic(errBufferClosed)
+	}
 	rw.ints = append(rw.ints, n)
+	observers := rw.observers
 	rw.wait.Broadcast()
 	rw.wait.L.Unlock()
+	for _, o := range observers {
+		o.WriteInt(n)
+	}
+}
+
+func (rw *intBuffer) isFull() bool {
+	return rw.capacity > 0 && len(rw.ints) >= rw.capacity
+}
+
+// Full reports whether a write would wait.
+func (rw *intBuffer) Full() bool {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	return rw.isFull() && !rw.closed
+}
+
+// Len returns the number of values waiting to be read.
+func (rw *intBuffer) Len() int {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	return len(rw.ints)
+}
+
+// Drain removes and returns everything currently in the buffer.
+func (rw *intBuffer) Drain() []int {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	ints := rw.ints
+	rw.ints = nil
+	rw.wait.Broadcast()
+	return ints
+}
+
+// Close marks the end of the values. Readers get io.EOF once they've read
+// everything already written, and waiting writers panic.
+func (rw *intBuffer) Close() {
+	rw.wait.L.Lock()
+	if rw.closed {
+		rw.wait.L.Unlock()
+		return
+	}
+	rw.closed = true
+	observers := rw.observers
+	rw.wait.Broadcast()
+	rw.wait.L.Unlock()
+	for _, o := range observers {
+		o.Close()
+	}
+}
+
+// Tee passes every value written to the buffer from now on to each of the
+// observers, after it's been added to the buffer and without affecting
+// what's read from it. Observers are called on the writer's goroutine, so
+// a full observer buffer holds up the writer.
+func (rw *intBuffer) Tee(observers ...intObserver) {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	rw.observers = append(append([]intObserver{}, rw.observers...), observers...)
+}
+
+// An observerFunc is an intObserver that calls itself with each value and
+// ignores Close.
+type observerFunc func(n int)
+
+func (f observerFunc) WriteInt(n int) { f(n) }
+func (f observerFunc) Close()         {}
+
+// An intLogger is an intObserver that writes each value to w on its own
+// line, after prefix.
+type intLogger struct {
+	w      io.Writer
+	prefix string
+}
+
+func (l *intLogger) WriteInt(n int) { fmt.Fprintf(l.w, "%s%d\n", l.prefix, n) }
+func (l *intLogger) Close()         { fmt.Fprintf(l.w, "%sclosed\n", l.prefix) }
+
+// merge returns a buffer that gets a copy of every value written to any of
+// the sources from now on, in the order they were written. It's closed once
+// all of the sources are, so straight away if there aren't any.
+func merge(sources ...*intBuffer) *intBuffer {
+	m := &merger{out: newIntBuffer(), open: len(sources)}
+	if len(sources) == 0 {
+		m.out.Close()
+	}
+	for _, src := range sources {
+		src.Tee(m)
+	}
+	return m.out
+}
+
+type merger struct {
+	out  *intBuffer
+	mu   sync.Mutex
+	open int
+}
+
+func (m *merger) WriteInt(n int) { m.out.WriteInt(n) }
+
+func (m *merger) Close() {
+	m.mu.Lock()
+	m.open--
+	last := m.open == 0
+	m.mu.Unlock()
+	if last {
+		m.out.Close()
+	}
+}
+
+// machineVars holds the metrics of every published computer, keyed by
+// name. -metrics serves them as JSON on /debug/vars.
+var machineVars = expvar.NewMap("intcode_machines")
+
+// machineMetrics counts what a computer has done. Computers published
+// under the same name share their metrics, so the counts add up over every
+// run. They're updated on the computer's goroutine and can be read from any
+// other.
+type machineMetrics struct {
+	instructions atomic.Int64
+	inputs       atomic.Int64
+	outputs      atomic.Int64
+}
+
+// metricsMu serializes looking up and publishing metrics.
+var metricsMu sync.Mutex
+
+// publishedMetrics returns the metrics published as name, publishing new
+// ones if there aren't any yet.
+func publishedMetrics(name string) *machineMetrics {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if m, ok := machineVars.Get(name).(*machineMetrics); ok {
+		return m
+	}
+	m := new(machineMetrics)
+	machineVars.Set(name, m)
+	return m
+}
+
+// String implements expvar.Var.
+func (m *machineMetrics) String() string {
+	return fmt.Sprintf(`{"instructions": %d, "inputs": %d, "outputs": %d}`,
+		m.instructions.Load(), m.inputs.Load(), m.outputs.Load())
+}
+
+// serveMetrics serves the published metrics on http://addr/debug/vars in
+// the background. addr has to be a localhost address.
+func serveMetrics(addr string) error {
+	if host, _, err := net.SplitHostPort(addr); err == nil && !isLoopback(host) {
+		return errors.New("-metrics must be a localhost address")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving metrics on http://%s/debug/vars", l.Addr())
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go http.Serve(l, mux)
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func loadProgram(filename string) ([]int, error) {
@@ -242,61 +718,852 @@ func loadProgram(filename string) ([]int, error) {
 	return prg, nil
 }
 
-func tryPhases(prg, phases []int) int {
-	pipes := make([]*intBuffer, len(phases))
+// parseInts parses a comma separated list of ints.
+func parseInts(s string) ([]int, error) {
+	var ints []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", f)
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// loopOptions configure the feedback loop run by tryPhases.
+type loopOptions struct {
+	// newPipe makes the pipes between amplifiers. It defaults to
+	// newIntBuffer.
+	newPipe func() intPipe
+	// trace, if set, is where every signal passed between amplifiers is
+	// logged. It needs intBuffer pipes.
+	trace io.Writer
+	// record, if set, records the signal flow of each run. It needs
+	// intBuffer pipes.
+	record *flowRecorder
+	// ctx, if set, stops a run once it's done.
+	ctx context.Context
+	// metrics publishes each amplifier's metrics under its name.
+	metrics bool
+}
+
+// ringPipeSize is the capacity of ring buffers between amplifiers. The
+// scheduler stops an amplifier whose output is full, so it only needs to
+// hold a few signals.
+const ringPipeSize = 16
+
+// A loop is a feedback loop of amplifiers, where each one's output is the
+// next one's input and the last one's goes back to the first. It can be
+// run any number of times, resetting the same computers each time.
+type loop struct {
+	start *snapshot
+	amps  []*amplifier
+	opts  loopOptions
+}
+
+func newLoop(prg []int, size int, opts loopOptions) *loop {
+	if opts.newPipe == nil {
+		opts.newPipe = func() intPipe { return newIntBuffer() }
+	}
+	l := &loop{
+		start: newComputer(prg, nil, nil).snapshot(),
+		opts:  opts,
+	}
+	for i := 0; i < size; i++ {
+		c := newComputer(prg, nil, nil)
+		if opts.metrics {
+			c.metrics = publishedMetrics(ampName(i))
+		}
+		l.amps = append(l.amps, &amplifier{c: c})
+	}
+	return l
+}
+
+// run runs the loop with the given phases and returns the last amplifier's
+// final signal.
+func (l *loop) run(phases []int) (int, error) {
+	if len(phases) != len(l.amps) {
+		return 0, fmt.Errorf("%d phases for %d amplifiers", len(phases), len(l.amps))
+	}
+	pipes := make([]intPipe, len(phases))
 	for i := range phases {
-		pipes[i] = newIntBuffer()
+		pipes[i] = l.opts.newPipe()
 	}
-	amps := make([]*amplifier, len(phases))
 	for i, phase := range phases {
-		in := pipes[i]
-		out := pipes[(i+1)%len(phases)]
-		amps[i] = newAmplifier(prg, phase, in, out)
+		l.amps[i].reset(l.start, phase, pipes[i], pipes[(i+1)%len(pipes)])
+	}
+	if l.opts.trace != nil {
+		for i, pipe := range pipes {
+			buf, ok := pipe.(*intBuffer)
+			if !ok {
+				return 0, errors.New("tracing needs intBuffer pipes")
+			}
+			from := ampName((i + len(pipes) - 1) % len(pipes))
+			buf.Tee(&intLogger{w: l.opts.trace, prefix: fmt.Sprintf("%s -> %s: ", from, ampName(i))})
+		}
+		fmt.Fprintf(l.opts.trace, "phases %v\n", phases)
+	}
+	l.amps[0].addInput(0)
+	s := &scheduler{slice: defaultSlice, ctx: l.opts.ctx}
+	for _, amp := range l.amps {
+		s.machines = append(s.machines, amp.c)
+	}
+	if rec := l.opts.record; rec != nil {
+		if err := rec.attach(l.amps, pipes, phases); err != nil {
+			return 0, err
+		}
+		s.halted = rec.halt
+	}
+	if err := s.run(); err != nil {
+		return 0, err
+	}
+	// Every amplifier has halted, so nothing else will be written.
+	lastAmp := l.amps[len(l.amps)-1]
+	lastAmp.output.Close()
+	n, err := lastAmp.output.ReadInt()
+	if err == io.EOF {
+		return 0, errors.New("the last amplifier didn't output a signal")
+	}
+	if l.opts.record != nil {
+		l.opts.record.signal = n
+	}
+	return n, err
+}
+
+// A flowRecorder records a run of a feedback loop: every signal passed
+// between amplifiers, how many instructions each amplifier ran in each
+// round, and when each halted. An amplifier's round ends when it outputs a
+// signal. The first amplifier's starting signal isn't recorded.
+type flowRecorder struct {
+	amps   []*computer
+	phases []int
+	signal int
+	// events holds the signals and halts in the order they happened.
+	events []flowEvent
+	// rounds[i][r] is how many instructions amplifier i ran in round r+1,
+	// and tails[i] how many it ran after its last output.
+	rounds [][]int
+	tails  []int
+	// last[i] is amplifier i's step count at its last output.
+	last []int
+}
+
+// A flowEvent is a signal sent from one amplifier to another, or a halt
+// if to is -1.
+type flowEvent struct {
+	from  int
+	to    int
+	round int
+	// value is the signal, or for a halt, how many instructions the
+	// amplifier ran.
+	value int
+}
+
+func (r *flowRecorder) attach(amps []*amplifier, pipes []intPipe, phases []int) error {
+	n := len(amps)
+	r.amps = nil
+	for _, amp := range amps {
+		r.amps = append(r.amps, amp.c)
+	}
+	r.phases = append([]int{}, phases...)
+	r.events = nil
+	r.rounds = make([][]int, n)
+	r.tails = make([]int, n)
+	r.last = make([]int, n)
+	for i, pipe := range pipes {
+		buf, ok := pipe.(*intBuffer)
+		if !ok {
+			return errors.New("recording needs intBuffer pipes")
+		}
+		from, to := (i+n-1)%n, i
+		buf.Tee(observerFunc(func(v int) { r.sent(from, to, v) }))
+	}
+	return nil
+}
+
+// sent is called as amplifier from outputs v, during its output
+// instruction.
+func (r *flowRecorder) sent(from, to, v int) {
+	steps := r.amps[from].steps
+	r.rounds[from] = append(r.rounds[from], steps-r.last[from])
+	r.last[from] = steps
+	r.events = append(r.events, flowEvent{from: from, to: to, round: len(r.rounds[from]), value: v})
+}
+
+func (r *flowRecorder) halt(c *computer) {
+	for i, amp := range r.amps {
+		if amp == c {
+			r.tails[i] = c.steps - r.last[i]
+			r.events = append(r.events, flowEvent{from: i, to: -1, round: len(r.rounds[i]), value: c.steps})
+		}
+	}
+}
+
+func (r *flowRecorder) header() string {
+	return fmt.Sprintf("phases %v, signal %d; %s starts with 0", r.phases, r.signal, ampName(0))
+}
+
+// writeTable writes the signals sent in each round, the instructions each
+// amplifier ran per round, and when each halted.
+func (r *flowRecorder) writeTable(w io.Writer) error {
+	n := len(r.amps)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, r.header())
+	fmt.Fprintln(w)
+	// values[i][round-1] is the signal amplifier i sent in a round.
+	values := make([][]int, n)
+	rounds := 0
+	for _, e := range r.events {
+		if e.to >= 0 {
+			values[e.from] = append(values[e.from], e.value)
+		}
+		if e.round > rounds {
+			rounds = e.round
+		}
+	}
+	fmt.Fprint(tw, "round\t")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(tw, "%s -> %s\t", ampName(i), ampName((i+1)%n))
+	}
+	fmt.Fprintln(tw)
+	for round := 0; round < rounds; round++ {
+		fmt.Fprintf(tw, "%d\t", round+1)
+		for i := 0; i < n; i++ {
+			if round < len(values[i]) {
+				fmt.Fprintf(tw, "%d", values[i][round])
+			}
+			fmt.Fprint(tw, "\t")
+		}
+		fmt.Fprintln(tw)
+	}
+
+	fmt.Fprint(tw, "\ninstructions\t")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(tw, "%s\t", ampName(i))
+	}
+	fmt.Fprintln(tw)
+	for round := 0; round < rounds; round++ {
+		fmt.Fprintf(tw, "%d\t", round+1)
+		for i := 0; i < n; i++ {
+			if round < len(r.rounds[i]) {
+				fmt.Fprintf(tw, "%d", r.rounds[i][round])
+			}
+			fmt.Fprint(tw, "\t")
+		}
+		fmt.Fprintln(tw)
 	}
-	amps[0].addInput(0)
+	fmt.Fprint(tw, "after last\t")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(tw, "%d\t", r.tails[i])
+	}
+	fmt.Fprint(tw, "\ntotal\t")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(tw, "%d\t", r.amps[i].steps)
+	}
+	fmt.Fprintln(tw)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	for t, e := range r.events {
+		if e.to < 0 {
+			fmt.Fprintf(w, "%s halted after round %d, %d instructions, at event %d of %d\n",
+				ampName(e.from), e.round, e.value, t+1, len(r.events))
+		}
+	}
+	return nil
+}
+
+// writeTimeline writes the events in order, one per line, in a column for
+// the amplifier they happened to.
+func (r *flowRecorder) writeTimeline(w io.Writer) error {
+	n := len(r.amps)
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "event\tround")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(tw, "\t%s", ampName(i))
+	}
+	fmt.Fprintln(tw)
+	for t, e := range r.events {
+		fmt.Fprintf(tw, "%d\t%d", t+1, e.round)
+		for i := 0; i < n; i++ {
+			fmt.Fprint(tw, "\t")
+			switch {
+			case i != e.from:
+			case e.to < 0:
+				fmt.Fprintf(tw, "halt (%d)", e.value)
+			default:
+				fmt.Fprintf(tw, "%d -> %s (%d)", e.value, ampName(e.to), r.rounds[e.from][e.round-1])
+			}
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, r.header())
+	fmt.Fprintln(w, "(n) is how many instructions the amplifier ran that round, or in all when it halts")
+	fmt.Fprintln(w)
+	// The empty cells after an event pad its line out to the last column.
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		fmt.Fprint(w, strings.TrimRight(line, " \n"))
+		if strings.HasSuffix(line, "\n") {
+			fmt.Fprintln(w)
+		}
+	}
+	return nil
+}
+
+// writeSVG draws the events as a sequence diagram, with a lifeline for each
+// amplifier and time running down the page.
+func (r *flowRecorder) writeSVG(w io.Writer) error {
+	const (
+		laneWidth = 140
+		rowHeight = 24
+		left      = 50
+		top       = 60
+	)
+	n := len(r.amps)
+	width := left + n*laneWidth
+	height := top + len(r.events)*rowHeight + 20
+	lane := func(i int) int { return left + i*laneWidth + laneWidth/2 }
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="12">`+"\n", width, height)
+	fmt.Fprintln(b, `<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="6" markerHeight="6" orient="auto-start-reverse"><path d="M0,0 L10,5 L0,10 z"/></marker></defs>`)
+	fmt.Fprintf(b, `<text x="10" y="20">%s</text>`+"\n", r.header())
+	for i := 0; i < n; i++ {
+		x := lane(i)
+		fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle" font-weight="bold">%s</text>`+"\n", x, top-16, ampName(i))
+		fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#bbb"/>`+"\n", x, top-8, x, height-10)
+	}
+	for t, e := range r.events {
+		y := top + t*rowHeight + rowHeight/2
+		fmt.Fprintf(b, `<text x="10" y="%d" fill="#888">%d</text>`+"\n", y+4, e.round)
+		from := lane(e.from)
+		if e.to < 0 {
+			fmt.Fprintf(b, `<circle cx="%d" cy="%d" r="5" fill="red"><title>%s halted after %d instructions</title></circle>`+"\n",
+				from, y, ampName(e.from), e.value)
+			fmt.Fprintf(b, `<text x="%d" y="%d" fill="red">halt</text>`+"\n", from+8, y+4)
+			continue
+		}
+		to := lane(e.to)
+		fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="black" marker-end="url(#arrow)"><title>%s -> %s round %d: %d (%d instructions)</title></line>`+"\n",
+			from, y, to, y, ampName(e.from), ampName(e.to), e.round, e.value, r.rounds[e.from][e.round-1])
+		fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle">%d</text>`+"\n", (from+to)/2, y-4, e.value)
+	}
+	fmt.Fprintln(b, "</svg>")
+	return b.Flush()
+}
+
+// tryPhases runs a feedback loop of amplifiers with the given phases and
+// returns the last one's final signal.
+func tryPhases(prg, phases []int, opts loopOptions) (int, error) {
+	return newLoop(prg, len(phases), opts).run(phases)
+}
+
+// A setting is a phase setting and the signal it produced.
+type setting struct {
+	phases []int
+	signal int
+}
+
+// better reports whether a beats b. Ties go to the lexically smaller
+// phases, so the order doesn't depend on which worker finished first.
+func better(a, b setting) bool {
+	if a.signal != b.signal {
+		return a.signal > b.signal
+	}
+	for i := range a.phases {
+		if a.phases[i] != b.phases[i] {
+			return a.phases[i] < b.phases[i]
+		}
+	}
+	return false
+}
+
+// addTop adds s to top, which holds at most k settings, best first. A
+// phase set with repeated phases has repeated orderings, which are only
+// kept once.
+func addTop(top []setting, s setting, k int) []setting {
+	i := sort.Search(len(top), func(i int) bool { return better(s, top[i]) })
+	if i >= k || i > 0 && !better(top[i-1], s) {
+		return top
+	}
+	top = append(top, setting{})
+	copy(top[i+1:], top[i:])
+	top[i] = s
+	if len(top) > k {
+		top = top[:k]
+	}
+	return top
+}
+
+// search runs a feedback loop with every ordering of phaseSet and returns
+// the k settings with the highest signals, best first. The orderings are
+// shared out between workers, each of which reuses a loop of its own.
+func search(prg, phaseSet []int, workers, k int, opts loopOptions) ([]setting, error) {
+	if workers < 1 || k < 1 {
+		return nil, fmt.Errorf("searching needs at least one worker and setting, not %d and %d", workers, k)
+	}
+	perms := make(chan []int)
+	results := make(chan setting)
+	errs := make(chan error, workers)
+	done := make(chan struct{})
+	var stop sync.Once
+
 	var wg sync.WaitGroup
-	for i := range phases {
-		i := i
-		amp := amps[i]
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
-			amp.runProgram()
-			wg.Done()
+			defer wg.Done()
+			l := newLoop(prg, len(phaseSet), opts)
+			for phases := range perms {
+				signal, err := l.run(phases)
+				if err != nil {
+					errs <- fmt.Errorf("phases %v: %w", phases, err)
+					stop.Do(func() { close(done) })
+					return
+				}
+				results <- setting{phases: phases, signal: signal}
+			}
 		}()
 	}
-	wg.Wait()
-	lastAmp := amps[len(amps)-1]
-	return lastAmp.output.ReadInt()
+	go func() {
+		eachPermutation(phaseSet, func(perm []int) bool {
+			select {
+			case perms <- append([]int{}, perm...):
+				return true
+			case <-done:
+				return false
+			}
+		})
+		close(perms)
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var top []setting
+	for r := range results {
+		top = addTop(top, r, k)
+	}
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+	return top, nil
+}
+
+// A network is a graph of amplifiers read from a network file. Each line of
+// the file is blank, a # comment, or one of:
+//
+//	amp <name> <phase>     an amplifier, with a phase or ? to search for one
+//	<name> -> <name>,...   send an amplifier's output to others' input
+//	input <name> <n>...    signals to give an amplifier after its phase
+//	result <name>          the network's result is this amplifier's last output
+//	phases <n>,...         the phases to try for the ? amplifiers
+//
+// Amplifiers have to be defined before other lines refer to them. An
+// amplifier's input is everything sent to it, in the order it was sent.
+type network struct {
+	nodes  []*netNode
+	byName map[string]*netNode
+	result *netNode
+	// phases are permuted over the nodes whose phase is searched for.
+	phases []int
+	// metrics publishes each amplifier's metrics under its name.
+	metrics bool
 }
 
-func permutations(s []int) [][]int {
-	if len(s) <= 1 {
-		return [][]int{s}
+type netNode struct {
+	name   string
+	phase  int
+	search bool
+	inputs []int
+	from   []*netNode
+}
+
+func parseNetwork(r io.Reader) (*network, error) {
+	n := &network{byName: make(map[string]*netNode)}
+	node := func(name string) (*netNode, error) {
+		if nd, ok := n.byName[name]; ok {
+			return nd, nil
+		}
+		return nil, fmt.Errorf("no amplifier %q", name)
+	}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if err := n.parseLine(s, node); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-	var all [][]int
-	for i, n := range s {
-		rest := append(append([]int{}, s[:i]...), s[i+1:]...)
-		tails := permutations(rest)
-		for _, tail := range tails {
-			all = append(all, append([]int{n}, tail...))
+	if n.result == nil {
+		return nil, errors.New("network has no result")
+	}
+	searched := 0
+	for _, nd := range n.nodes {
+		if nd.search {
+			searched++
 		}
 	}
-	return all
+	if searched != len(n.phases) {
+		return nil, fmt.Errorf("%d amplifiers need a phase but %d phases are given", searched, len(n.phases))
+	}
+	return n, nil
+}
+
+func (n *network) parseLine(s string, node func(string) (*netNode, error)) error {
+	if from, to, ok := strings.Cut(s, "->"); ok {
+		src, err := node(strings.TrimSpace(from))
+		if err != nil {
+			return err
+		}
+		for _, name := range strings.Split(to, ",") {
+			dst, err := node(strings.TrimSpace(name))
+			if err != nil {
+				return err
+			}
+			dst.from = append(dst.from, src)
+		}
+		return nil
+	}
+	fields := strings.Fields(s)
+	switch fields[0] {
+	case "amp":
+		if len(fields) != 3 {
+			return errors.New("expected amp <name> <phase>")
+		}
+		name := fields[1]
+		if _, ok := n.byName[name]; ok {
+			return fmt.Errorf("amplifier %q is already defined", name)
+		}
+		nd := &netNode{name: name}
+		if fields[2] == "?" {
+			nd.search = true
+		} else {
+			phase, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return fmt.Errorf("bad phase %q", fields[2])
+			}
+			nd.phase = phase
+		}
+		n.nodes = append(n.nodes, nd)
+		n.byName[name] = nd
+	case "input":
+		if len(fields) < 3 {
+			return errors.New("expected input <name> <n>...")
+		}
+		nd, err := node(fields[1])
+		if err != nil {
+			return err
+		}
+		for _, f := range fields[2:] {
+			v, err := strconv.Atoi(f)
+			if err != nil {
+				return fmt.Errorf("bad input %q", f)
+			}
+			nd.inputs = append(nd.inputs, v)
+		}
+	case "result":
+		if len(fields) != 2 {
+			return errors.New("expected result <name>")
+		}
+		nd, err := node(fields[1])
+		if err != nil {
+			return err
+		}
+		n.result = nd
+	case "phases":
+		if n.phases != nil {
+			return errors.New("phases are already given")
+		}
+		phases, err := parseInts(strings.TrimSpace(strings.TrimPrefix(s, "phases")))
+		if err != nil {
+			return err
+		}
+		n.phases = phases
+	default:
+		return fmt.Errorf("unknown line %q", s)
+	}
+	return nil
+}
+
+func loadNetwork(filename string) (*network, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseNetwork(f)
+}
+
+// run runs the network with the searched-for amplifiers given phases in
+// order, and returns the result amplifier's last output. If trace isn't
+// nil, every amplifier's outputs are logged to it.
+func (n *network) run(ctx context.Context, prg, phases []int, trace io.Writer) (int, error) {
+	outputs := make(map[*netNode]*intBuffer)
+	for _, nd := range n.nodes {
+		outputs[nd] = newIntBuffer()
+		if trace != nil {
+			outputs[nd].Tee(&intLogger{w: trace, prefix: nd.name + ": "})
+		}
+	}
+	s := &scheduler{slice: defaultSlice, ctx: ctx}
+	for _, nd := range n.nodes {
+		var sources []*intBuffer
+		for _, src := range nd.from {
+			sources = append(sources, outputs[src])
+		}
+		phase := nd.phase
+		if nd.search {
+			phase, phases = phases[0], phases[1:]
+		}
+		// An amplifier nothing sends to only gets its phase and inputs, so
+		// its input is closed once they're written.
+		in := newIntBuffer()
+		if len(sources) > 0 {
+			in = merge(sources...)
+		}
+		amp := newAmplifier(prg, phase, in, outputs[nd])
+		for _, v := range nd.inputs {
+			amp.addInput(v)
+		}
+		if len(sources) == 0 {
+			in.Close()
+		}
+		if n.metrics {
+			amp.c.metrics = publishedMetrics(nd.name)
+		}
+		s.machines = append(s.machines, amp.c)
+	}
+	if err := s.run(); err != nil {
+		return 0, err
+	}
+	out := outputs[n.result].Drain()
+	if len(out) == 0 {
+		return 0, fmt.Errorf("amplifier %s didn't output a signal", n.result.name)
+	}
+	return out[len(out)-1], nil
+}
+
+// best runs the network with every permutation of its phases and returns
+// the highest result.
+func (n *network) best(ctx context.Context, prg []int, trace io.Writer) (int, error) {
+	var max int
+	var err error
+	first := true
+	eachPermutation(n.phases, func(perm []int) bool {
+		if trace != nil && len(perm) > 0 {
+			fmt.Fprintf(trace, "phases %v\n", perm)
+		}
+		var output int
+		if output, err = n.run(ctx, prg, append([]int{}, perm...), trace); err != nil {
+			err = fmt.Errorf("phases %v: %w", perm, err)
+			return false
+		}
+		if first || output > max {
+			max = output
+			first = false
+		}
+		return true
+	})
+	return max, err
+}
+
+// ampName names amplifiers A, B, C and so on.
+func ampName(i int) string {
+	if i < 26 {
+		return string(rune('A' + i))
+	}
+	return fmt.Sprintf("amp%d", i)
+}
+
+// eachPermutation calls fn with every ordering of s, generated one at a
+// time by Heap's algorithm, until fn returns false. fn is passed the same
+// slice each time, reordered, so it has to copy it to keep it.
+func eachPermutation(s []int, fn func(perm []int) bool) {
+	s = append([]int{}, s...)
+	// c[i] counts the swaps made at position i since the positions before
+	// it were last reset.
+	c := make([]int, len(s))
+	if !fn(s) {
+		return
+	}
+	for i := 1; i < len(s); {
+		if c[i] >= i {
+			c[i] = 0
+			i++
+			continue
+		}
+		if i%2 == 0 {
+			s[0], s[i] = s[i], s[0]
+		} else {
+			s[c[i]], s[i] = s[i], s[c[i]]
+		}
+		if !fn(s) {
+			return
+		}
+		c[i]++
+		i = 1
+	}
+}
+
+// showFlow records a run of the feedback loop and writes it to stdout in
+// the given format. The phases are phaseList, or if that's empty, the best
+// ordering of phaseSet.
+func showFlow(prg []int, format, phaseList, phaseSet string, workers int, opts loopOptions) error {
+	rec := new(flowRecorder)
+	write := map[string]func(io.Writer) error{
+		"table":    rec.writeTable,
+		"timeline": rec.writeTimeline,
+		"svg":      rec.writeSVG,
+	}[format]
+	if write == nil {
+		return fmt.Errorf("unknown flow format %q", format)
+	}
+	var phases []int
+	var err error
+	if phaseList != "" {
+		phases, err = parseInts(phaseList)
+	} else {
+		var set []int
+		if set, err = parseInts(phaseSet); err != nil {
+			return err
+		}
+		var best []setting
+		best, err = search(prg, set, workers, 1, opts)
+		if err == nil && len(best) == 0 {
+			err = errors.New("no phase settings were tried")
+		}
+		if err == nil {
+			phases = best[0].phases
+		}
+	}
+	if err != nil {
+		return err
+	}
+	opts.record = rec
+	if _, err := tryPhases(prg, phases, opts); err != nil {
+		return fmt.Errorf("phases %v: %w", phases, err)
+	}
+	return write(os.Stdout)
 }
 
 func run() error {
+	phaseList := flag.String("phases", "", "comma separated phases to try, instead of searching")
+	phaseSet := flag.String("phase-set", "5,6,7,8,9", "comma separated phases to try every ordering of, one per amplifier")
+	workers := flag.Int("workers", runtime.NumCPU(), "phase settings to try at once")
+	top := flag.Int("top", 0, "print the n best phase settings with their signals instead of the best signal")
+	flow := flag.String("flow", "", "show the signal flow of -phases, or of the best phases, as a table, timeline or svg")
+	trace := flag.Bool("trace", false, "log the signals passed between amplifiers to stderr")
+	transport := flag.String("transport", "buffer", "pipes between amplifiers: buffer or ring")
+	networkFile := flag.String("network", "", "network file describing the amplifiers to run instead of the feedback loop")
+	timeout := flag.Duration("timeout", 0, "give up after this long, if positive")
+	metricsAddr := flag.String("metrics", "", "localhost address to serve each computer's metrics on")
+	flag.Parse()
+	if *metricsAddr != "" {
+		if err := serveMetrics(*metricsAddr); err != nil {
+			return err
+		}
+	}
+	if *workers < 1 {
+		return errors.New("-workers must be at least 1")
+	}
+	if *top < 0 {
+		return errors.New("-top must not be negative")
+	}
+
 	prg, err := loadProgram("input.txt")
 	if err != nil {
 		return err
 	}
-	max := 0
-	for _, perm := range permutations([]int{5, 6, 7, 8, 9}) {
-		output := tryPhases(prg, perm)
-		if output > max {
-			max = output
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	if *networkFile != "" {
+		n, err := loadNetwork(*networkFile)
+		if err != nil {
+			return err
+		}
+		n.metrics = *metricsAddr != ""
+		var traceW io.Writer
+		if *trace {
+			traceW = os.Stderr
 		}
+		result, err := n.best(ctx, prg, traceW)
+		if err != nil {
+			return err
+		}
+		fmt.Println(result)
+		return nil
+	}
+	opts := loopOptions{ctx: ctx, metrics: *metricsAddr != ""}
+	switch *transport {
+	case "buffer":
+	case "ring":
+		opts.newPipe = func() intPipe { return newRingBuffer(ringPipeSize) }
+	default:
+		return fmt.Errorf("unknown transport %q", *transport)
+	}
+	if *trace {
+		opts.trace = os.Stderr
+		// Traces from several loops at once would be interleaved.
+		*workers = 1
+	}
+	if *flow != "" {
+		return showFlow(prg, *flow, *phaseList, *phaseSet, *workers, opts)
+	}
+	if *phaseList != "" {
+		phases, err := parseInts(*phaseList)
+		if err != nil {
+			return err
+		}
+		signal, err := tryPhases(prg, phases, opts)
+		if err != nil {
+			return fmt.Errorf("phases %v: %w", phases, err)
+		}
+		fmt.Println(signal)
+		return nil
+	}
+
+	set, err := parseInts(*phaseSet)
+	if err != nil {
+		return err
+	}
+	k := *top
+	if k < 1 {
+		k = 1
+	}
+	best, err := search(prg, set, *workers, k, opts)
+	if err != nil {
+		return err
+	}
+	if len(best) == 0 {
+		return errors.New("no phase settings were tried")
+	}
+	if *top < 1 {
+		fmt.Println(best[0].signal)
+		return nil
+	}
+	for _, s := range best {
+		fmt.Printf("%v\t%d\n", s.phases, s.signal)
 	}
-	fmt.Println(max)
 	return nil
 }
 
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"aoc2019/intcode/conformance"
+)
+
+// feedbackExample is the second feedback loop example from the puzzle,
+// whose best phases 9,8,7,6,5 give a signal of 139629729.
+var feedbackExample = []int{
+	3, 26, 1001, 26, -4, 26, 3, 27, 1002, 27, 2, 27, 1, 27, 26,
+	27, 4, 27, 1001, 28, -1, 28, 1005, 28, 6, 99, 0, 0, 5,
+}
+
+var transports = []struct {
+	name    string
+	newPipe func() intPipe
+}{
+	{"buffer", func() intPipe { return newIntBuffer() }},
+	{"ring", func() intPipe { return newRingBuffer(ringPipeSize) }},
+}
+
+// BenchmarkPipe passes values from one goroutine to another through each
+// transport.
+func BenchmarkPipe(b *testing.B) {
+	const values = 10_000
+	for _, t := range transports {
+		b.Run(t.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pipe := t.newPipe()
+				done := make(chan struct{})
+				go func() {
+					for {
+						if _, err := pipe.ReadInt(); err != nil {
+							break
+						}
+					}
+					close(done)
+				}()
+				for n := 0; n < values; n++ {
+					pipe.WriteInt(n)
+				}
+				pipe.Close()
+				<-done
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*values), "ns/value")
+		})
+	}
+}
+
+// BenchmarkLoop runs the feedback loop for every phase ordering with each
+// transport as its pipes.
+func BenchmarkLoop(b *testing.B) {
+	for _, t := range transports {
+		b.Run(t.name, func(b *testing.B) {
+			b.ReportAllocs()
+			l := newLoop(feedbackExample, 5, loopOptions{newPipe: t.newPipe})
+			for i := 0; i < b.N; i++ {
+				var err error
+				eachPermutation([]int{5, 6, 7, 8, 9}, func(perm []int) bool {
+					_, err = l.run(perm)
+					return err == nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func conformanceRun(prg, input []int) (output, memory []int, err error) {
+	in, out := newIntBuffer(), newIntBuffer()
+	for _, n := range input {
+		in.WriteInt(n)
+	}
+	in.Close()
+	c := newComputer(prg, in, out)
+	c.runProgram()
+	return out.Drain(), c.memory, nil
+}
+
+func TestFeedbackExample(t *testing.T) {
+	best, err := search(feedbackExample, []int{5, 6, 7, 8, 9}, 2, 1, loopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(best) != 1 || best[0].signal != 139629729 {
+		t.Errorf("best = %v, want a signal of 139629729", best)
+	}
+}
+
+func TestLoopMetrics(t *testing.T) {
+	// Metrics add up over every run, so count from what's there already.
+	var inputs, outputs []int64
+	for i := 0; i < 5; i++ {
+		m := publishedMetrics(ampName(i))
+		inputs = append(inputs, m.inputs.Load())
+		outputs = append(outputs, m.outputs.Load())
+	}
+	l := newLoop(feedbackExample, 5, loopOptions{metrics: true})
+	if _, err := l.run([]int{9, 8, 7, 6, 5}); err != nil {
+		t.Fatal(err)
+	}
+	// Each amplifier reads its phase and one signal per round, and outputs
+	// a signal per round. The example goes round the loop five times.
+	for i := range l.amps {
+		m := publishedMetrics(ampName(i))
+		if got := m.inputs.Load() - inputs[i]; got != 6 {
+			t.Errorf("amplifier %s read %d inputs, want 6", ampName(i), got)
+		}
+		if got := m.outputs.Load() - outputs[i]; got != 5 {
+			t.Errorf("amplifier %s wrote %d outputs, want 5", ampName(i), got)
+		}
+	}
+}
+
+func TestMergeNoSources(t *testing.T) {
+	if _, err := merge().ReadInt(); err != io.EOF {
+		t.Errorf("reading a merge of nothing returned %v, want io.EOF", err)
+	}
+}
+
+// TestConformance runs the spec programs up to day 7, the last day whose
+// instructions this computer implements.
+func TestConformance(t *testing.T) {
+	conformance.Test(t, 7, conformanceRun)
+}
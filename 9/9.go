@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"unicode"
 )
 
 type mode int
@@ -29,7 +35,16 @@ type computer struct {
 	running bool
 }
 
-func (c *computer) runProgram() {
+// runProgram runs the program until it halts. A program that fails, for
+// example by reading more input than it was given, halts and returns an
+// error.
+func (c *computer) runProgram() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.running = false
+			err = fmt.Errorf("%v", r)
+		}
+	}()
 	for c.running {
 		code, modes := parseOpcodeModes(c.next())
 		op, ok := opcodes[code]
@@ -38,6 +53,7 @@ func (c *computer) runProgram() {
 		}
 		op(c, modes)
 	}
+	return nil
 }
 
 func parseOpcodeModes(value int) (code int, modes []mode) {
@@ -126,7 +142,10 @@ func mul(c *computer, modes []mode) {
 
 func input(c *computer, modes []mode) {
 	modes = fillModes(modes, 1)
-	n := c.input.ReadInt()
+	n, err := c.input.ReadInt()
+	if err != nil {
+		panic(fmt.Sprintf("reading input: %v", err))
+	}
 	c.write(n, modes[0])
 }
 
@@ -199,36 +218,74 @@ var opcodes map[int]opcode = map[int]opcode{
 	99: halt,
 }
 
+var errBufferClosed = errors.New("buffer is closed")
+
+// An intBuffer is an unbounded queue of ints between a computer and
+// whatever feeds it or reads its output. Once it's closed, reads return
+// what's left and then io.EOF.
 type intBuffer struct {
-	wait *sync.Cond
-	ints []int
+	wait   *sync.Cond
+	ints   []int
+	closed bool
 }
 
 func newIntBuffer() *intBuffer {
 	var mu sync.Mutex
-	return &intBuffer{
-		wait: sync.NewCond(&mu),
-	}
+	return &intBuffer{wait: sync.NewCond(&mu)}
 }
 
-func (rw *intBuffer) ReadInt() int {
+// ReadInt removes and returns the next value, waiting until there is one.
+func (rw *intBuffer) ReadInt() (int, error) {
 	rw.wait.L.Lock()
-	for len(rw.ints) == 0 {
+	defer rw.wait.L.Unlock()
+	for len(rw.ints) == 0 && !rw.closed {
 		rw.wait.Wait()
 	}
+	if len(rw.ints) == 0 {
+		return 0, io.EOF
+	}
 	n := rw.ints[0]
 	rw.ints = rw.ints[1:]
-	rw.wait.L.Unlock()
-	return n
+	rw.wait.Broadcast()
+	return n, nil
 }
 
+// WriteInt adds a value. It panics if the buffer is closed, like sending
+// on a closed channel.
 func (rw *intBuffer) WriteInt(n int) {
 	rw.wait.L.Lock()
+	if rw.closed {
+		rw.wait.L.Unlock()
+		panic(errBufferClosed)
+	}
 	rw.ints = append(rw.ints, n)
 	rw.wait.Broadcast()
 	rw.wait.L.Unlock()
 }
 
+// Drain removes and returns everything currently in the buffer.
+func (rw *intBuffer) Drain() []int {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	ints := rw.ints
+	rw.ints = nil
+	rw.wait.Broadcast()
+	return ints
+}
+
+// Close marks the end of the values. Readers get io.EOF once they've read
+// everything already written.
+func (rw *intBuffer) Close() {
+	rw.wait.L.Lock()
+	if rw.closed {
+		rw.wait.L.Unlock()
+		return
+	}
+	rw.closed = true
+	rw.wait.Broadcast()
+	rw.wait.L.Unlock()
+}
+
 func loadProgram(filename string) ([]int, error) {
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -245,17 +302,77 @@ func loadProgram(filename string) ([]int, error) {
 	return prg, nil
 }
 
+// parseInputs parses a comma or whitespace separated list of integers.
+func parseInputs(s string) ([]int, error) {
+	var ints []int
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// readInputs returns the values of an -input flag. "-" takes the next line
+// of stdin, so each -input - gets a line of its own.
+func readInputs(s string, stdin *bufio.Reader) ([]int, error) {
+	if s == "-" {
+		line, err := stdin.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, fmt.Errorf("reading stdin: %w", err)
+		}
+		s = line
+	}
+	return parseInputs(s)
+}
+
+// inputFlags collects each -input flag. The program is run once per flag.
+type inputFlags []string
+
+func (f *inputFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *inputFlags) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
 func run() error {
+	var inputs inputFlags
+	flag.Var(&inputs, "input", "comma or space separated program input, or - to read a line of stdin (repeatable)")
+	flag.Parse()
+	if len(inputs) == 0 {
+		inputs = inputFlags{"1", "2"}
+	}
+
 	prg, err := loadProgram("input.txt")
 	if err != nil {
 		return err
 	}
-	in := newIntBuffer()
-	in.WriteInt(2)
-	out := newIntBuffer()
-	c := newComputer(prg, in, out)
-	c.runProgram()
-	fmt.Println(out.ints)
+	stdin := bufio.NewReader(os.Stdin)
+	for _, s := range inputs {
+		ints, err := readInputs(s, stdin)
+		if err != nil {
+			return fmt.Errorf("input %s: %w", s, err)
+		}
+		in := newIntBuffer()
+		for _, n := range ints {
+			in.WriteInt(n)
+		}
+		in.Close()
+		out := newIntBuffer()
+		c := newComputer(prg, in, out)
+		if err := c.runProgram(); err != nil {
+			return fmt.Errorf("input %v: %w", ints, err)
+		}
+		fmt.Printf("input %v: %v\n", ints, out.Drain())
+	}
 	return nil
 }
 
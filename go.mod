@@ -0,0 +1,3 @@
+module aoc2019
+
+go 1.21
@@ -0,0 +1,1013 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The compiler takes a small C-like language to intcode:
+//
+//	var total = 0;
+//
+//	func fib(n) {
+//		if (n < 2) {
+//			return n;
+//		}
+//		return fib(n - 1) + fib(n - 2);
+//	}
+//
+//	func main() {
+//		var n = input();
+//		while (n > 0) {
+//			output(fib(n));
+//			total = total + 1;
+//			n = n - 1;
+//		}
+//	}
+//
+// Everything is an integer. Globals may only be initialized with constants.
+// The operators are those of the debugger's expressions except / and %,
+// which intcode has no instructions for. Statements are var declarations,
+// assignments, if/else, while, break, continue, return and expressions,
+// and the builtins input() and output(x) read and write a value.
+//
+// Each call gets a frame on a stack addressed with the relative base:
+// frame[0] is the return address, followed by the parameters, the locals
+// and then temporaries. The caller moves the relative base to the new frame
+// before pushing the return address and jumping, which is the call idiom
+// the decompiler recognizes, and the callee returns its result in frame[1].
+
+type token struct {
+	text string
+	line int
+	col  int
+}
+
+func (t token) String() string {
+	if t.text == "" {
+		return "end of file"
+	}
+	return strconv.Quote(t.text)
+}
+
+type compileError struct {
+	line, col int
+	msg       string
+}
+
+func (e *compileError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.line, e.col, e.msg)
+}
+
+func errorAt(t token, format string, args ...interface{}) error {
+	return &compileError{t.line, t.col, fmt.Sprintf(format, args...)}
+}
+
+var punctuation = []string{
+	"||", "&&", "==", "!=", "<=", ">=",
+	"<", ">", "+", "-", "*", "!", "=", "(", ")", "{", "}", ",", ";",
+}
+
+func tokenize(src string) ([]token, error) {
+	var toks []token
+	line, col := 1, 1
+	advance := func(n int) {
+		for _, ch := range src[:n] {
+			if ch == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+		}
+		src = src[n:]
+	}
+	for len(src) > 0 {
+		ch := rune(src[0])
+		switch {
+		case unicode.IsSpace(ch):
+			advance(1)
+			continue
+		case strings.HasPrefix(src, "//"):
+			end := strings.Index(src, "\n")
+			if end < 0 {
+				end = len(src)
+			}
+			advance(end)
+			continue
+		}
+		n := 0
+		switch {
+		case unicode.IsDigit(ch):
+			for n < len(src) && unicode.IsDigit(rune(src[n])) {
+				n++
+			}
+		case unicode.IsLetter(ch) || ch == '_':
+			for n < len(src) && (unicode.IsLetter(rune(src[n])) || unicode.IsDigit(rune(src[n])) || src[n] == '_') {
+				n++
+			}
+		default:
+			for _, p := range punctuation {
+				if strings.HasPrefix(src, p) {
+					n = len(p)
+					break
+				}
+			}
+		}
+		if n == 0 {
+			return nil, &compileError{line, col, fmt.Sprintf("unexpected %q", ch)}
+		}
+		toks = append(toks, token{src[:n], line, col})
+		advance(n)
+	}
+	toks = append(toks, token{"", line, col})
+	return toks, nil
+}
+
+type expr interface{}
+
+type (
+	numberExpr struct {
+		tok   token
+		value int
+	}
+	nameExpr struct {
+		tok token
+	}
+	unaryExpr struct {
+		op token
+		x  expr
+	}
+	binaryExpr struct {
+		op   token
+		x, y expr
+	}
+	callExpr struct {
+		name token
+		args []expr
+	}
+)
+
+type stmt interface{}
+
+type (
+	varStmt struct {
+		name token
+		init expr
+	}
+	assignStmt struct {
+		name  token
+		value expr
+	}
+	ifStmt struct {
+		cond expr
+		then []stmt
+		els  []stmt
+	}
+	whileStmt struct {
+		cond expr
+		body []stmt
+	}
+	returnStmt struct {
+		tok   token
+		value expr
+	}
+	branchStmt struct {
+		tok token
+	}
+	exprStmt struct {
+		x expr
+	}
+)
+
+type funcDecl struct {
+	name   token
+	params []token
+	body   []stmt
+}
+
+type globalDecl struct {
+	name  token
+	value int
+}
+
+type sourceFile struct {
+	globals []*globalDecl
+	funcs   []*funcDecl
+	end     token // the end of the source, for errors about the whole file
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.text != "" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(text string) bool {
+	if p.peek().text == text {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) (token, error) {
+	t := p.next()
+	if t.text != text {
+		return t, errorAt(t, "expected %q, found %s", text, t)
+	}
+	return t, nil
+}
+
+func isIdent(t token) bool {
+	if t.text == "" || !(unicode.IsLetter(rune(t.text[0])) || t.text[0] == '_') {
+		return false
+	}
+	switch t.text {
+	case "var", "func", "if", "else", "while", "return", "break", "continue":
+		return false
+	}
+	return true
+}
+
+func (p *parser) ident() (token, error) {
+	t := p.next()
+	if !isIdent(t) {
+		return t, errorAt(t, "expected a name, found %s", t)
+	}
+	return t, nil
+}
+
+func parseSource(src string) (*sourceFile, error) {
+	toks, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	f := new(sourceFile)
+	for p.peek().text != "" {
+		switch t := p.next(); t.text {
+		case "var":
+			g, err := p.global()
+			if err != nil {
+				return nil, err
+			}
+			f.globals = append(f.globals, g)
+		case "func":
+			fn, err := p.function()
+			if err != nil {
+				return nil, err
+			}
+			f.funcs = append(f.funcs, fn)
+		default:
+			return nil, errorAt(t, "expected var or func, found %s", t)
+		}
+	}
+	f.end = p.peek()
+	return f, nil
+}
+
+func (p *parser) global() (*globalDecl, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	g := &globalDecl{name: name}
+	if p.accept("=") {
+		neg := p.accept("-")
+		t := p.next()
+		n, err := strconv.Atoi(t.text)
+		if err != nil {
+			return nil, errorAt(t, "globals must be initialized with a constant")
+		}
+		if neg {
+			n = -n
+		}
+		g.value = n
+	}
+	_, err = p.expect(";")
+	return g, err
+}
+
+func (p *parser) function() (*funcDecl, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	fn := &funcDecl{name: name}
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.accept(")") {
+		if len(fn.params) > 0 {
+			if _, err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		param, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, param)
+	}
+	fn.body, err = p.block()
+	return fn, err
+}
+
+func (p *parser) block() ([]stmt, error) {
+	if _, err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var stmts []stmt
+	for !p.accept("}") {
+		if p.peek().text == "" {
+			return nil, errorAt(p.peek(), "missing }")
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, s)
+	}
+	return stmts, nil
+}
+
+func (p *parser) statement() (stmt, error) {
+	t := p.peek()
+	switch t.text {
+	case "var":
+		p.next()
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		s := &varStmt{name: name}
+		if p.accept("=") {
+			if s.init, err = p.expr(0); err != nil {
+				return nil, err
+			}
+		}
+		_, err = p.expect(";")
+		return s, err
+	case "if":
+		p.next()
+		cond, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		s := &ifStmt{cond: cond}
+		if s.then, err = p.block(); err != nil {
+			return nil, err
+		}
+		if p.accept("else") {
+			if p.peek().text == "if" {
+				elif, err := p.statement()
+				if err != nil {
+					return nil, err
+				}
+				s.els = []stmt{elif}
+			} else if s.els, err = p.block(); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case "while":
+		p.next()
+		cond, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		return &whileStmt{cond: cond, body: body}, err
+	case "return":
+		p.next()
+		s := &returnStmt{tok: t}
+		if !p.accept(";") {
+			var err error
+			if s.value, err = p.expr(0); err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(";"); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case "break", "continue":
+		p.next()
+		_, err := p.expect(";")
+		return &branchStmt{tok: t}, err
+	}
+	if isIdent(t) && p.toks[p.pos+1].text == "=" {
+		p.pos += 2
+		value, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(";")
+		return &assignStmt{name: t, value: value}, err
+	}
+	x, err := p.expr(0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(";")
+	return &exprStmt{x}, err
+}
+
+func (p *parser) condition() (expr, error) {
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+	cond, err := p.expr(0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(")")
+	return cond, err
+}
+
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*"},
+}
+
+func (p *parser) expr(level int) (expr, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+	x, err := p.expr(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		found := false
+		for _, candidate := range precedence[level] {
+			found = found || op.text == candidate
+		}
+		if !found {
+			return x, nil
+		}
+		p.next()
+		y, err := p.expr(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op, x, y}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	if op := p.peek(); op.text == "-" || op.text == "!" {
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := x.(*numberExpr); ok && op.text == "-" {
+			return &numberExpr{op, -n.value}, nil
+		}
+		return &unaryExpr{op, x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	if n, err := strconv.Atoi(t.text); err == nil {
+		return &numberExpr{t, n}, nil
+	}
+	if t.text == "(" {
+		x, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(")")
+		return x, err
+	}
+	if !isIdent(t) {
+		return nil, errorAt(t, "unexpected %s", t)
+	}
+	if !p.accept("(") {
+		return &nameExpr{t}, nil
+	}
+	call := &callExpr{name: t}
+	for !p.accept(")") {
+		if len(call.args) > 0 {
+			if _, err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	return call, nil
+}
+
+// An arg is an instruction parameter. If label is set, the parameter is
+// the label's address plus value.
+type arg struct {
+	mode  mode
+	value int
+	label string
+}
+
+func imm(n int) arg         { return arg{mode: modeImmediate, value: n} }
+func slot(n int) arg        { return arg{mode: modeRelative, value: n} }
+func labelArg(l string) arg { return arg{mode: modeImmediate, label: l} }
+
+type fixup struct {
+	at    int
+	label string
+}
+
+type assembler struct {
+	code    []int
+	labels  map[string]int
+	fixups  []fixup
+	nlabels int
+}
+
+func (a *assembler) newLabel(prefix string) string {
+	a.nlabels++
+	return fmt.Sprintf("%s.%d", prefix, a.nlabels)
+}
+
+func (a *assembler) mark(label string) {
+	a.labels[label] = len(a.code)
+}
+
+func (a *assembler) instr(code int, args ...arg) {
+	value, scale := code, 100
+	for _, p := range args {
+		value += int(p.mode) * scale
+		scale *= 10
+	}
+	a.code = append(a.code, value)
+	for _, p := range args {
+		if p.label != "" {
+			a.fixups = append(a.fixups, fixup{len(a.code), p.label})
+		}
+		a.code = append(a.code, p.value)
+	}
+}
+
+func (a *assembler) jump(label string) {
+	a.instr(5, imm(1), labelArg(label))
+}
+
+func (a *assembler) link() []int {
+	for _, f := range a.fixups {
+		a.code[f.at] += a.labels[f.label]
+	}
+	return a.code
+}
+
+type loop struct {
+	brk, cont string
+}
+
+type codegen struct {
+	a       *assembler
+	globals map[string]arg
+	funcs   map[string]*funcDecl
+
+	// Per function.
+	scopes    []map[string]arg
+	nextSlot  int
+	frameSize int
+	loops     []loop
+}
+
+func countLocals(stmts []stmt) int {
+	n := 0
+	for _, s := range stmts {
+		switch s := s.(type) {
+		case *varStmt:
+			n++
+		case *ifStmt:
+			n += countLocals(s.then) + countLocals(s.els)
+		case *whileStmt:
+			n += countLocals(s.body)
+		}
+	}
+	return n
+}
+
+func compileSource(src string) ([]int, error) {
+	f, err := parseSource(src)
+	if err != nil {
+		return nil, err
+	}
+	g := &codegen{
+		a:       &assembler{labels: make(map[string]int)},
+		globals: make(map[string]arg),
+		funcs:   make(map[string]*funcDecl),
+	}
+	for _, fn := range f.funcs {
+		if fn.name.text == "input" || fn.name.text == "output" {
+			return nil, errorAt(fn.name, "%s is a builtin and can't be redeclared", fn.name.text)
+		}
+		if _, dup := g.funcs[fn.name.text]; dup {
+			return nil, errorAt(fn.name, "%s redeclared", fn.name.text)
+		}
+		g.funcs[fn.name.text] = fn
+	}
+	for _, v := range f.globals {
+		if _, dup := g.globals[v.name.text]; dup {
+			return nil, errorAt(v.name, "%s redeclared", v.name.text)
+		}
+		g.globals[v.name.text] = arg{mode: modePosition, label: "global." + v.name.text}
+	}
+	main, ok := g.funcs["main"]
+	if !ok {
+		return nil, errorAt(f.end, "no main function")
+	}
+	if len(main.params) > 0 {
+		return nil, errorAt(main.name, "main must not take parameters")
+	}
+
+	a := g.a
+	a.instr(9, labelArg("stack"))
+	a.instr(1, labelArg("exit"), imm(0), slot(0))
+	a.jump("func.main")
+	a.mark("exit")
+	a.instr(99)
+	for _, fn := range f.funcs {
+		if err := g.function(fn); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range f.globals {
+		a.mark("global." + v.name.text)
+		a.code = append(a.code, v.value)
+	}
+	a.mark("stack")
+	return a.link(), nil
+}
+
+func (g *codegen) function(fn *funcDecl) error {
+	g.scopes = []map[string]arg{{}}
+	g.loops = nil
+	for i, p := range fn.params {
+		if _, dup := g.scopes[0][p.text]; dup {
+			return errorAt(p, "duplicate parameter %s", p.text)
+		}
+		g.scopes[0][p.text] = slot(1 + i)
+	}
+	g.nextSlot = 1 + len(fn.params)
+	g.frameSize = g.nextSlot + countLocals(fn.body)
+
+	g.a.mark("func." + fn.name.text)
+	if err := g.block(fn.body); err != nil {
+		return err
+	}
+	// Falling off the end returns 0.
+	g.a.instr(1, imm(0), imm(0), slot(1))
+	g.a.instr(6, imm(0), slot(0))
+	return nil
+}
+
+func (g *codegen) block(stmts []stmt) error {
+	g.scopes = append(g.scopes, map[string]arg{})
+	defer func() { g.scopes = g.scopes[:len(g.scopes)-1] }()
+	for _, s := range stmts {
+		if err := g.statement(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *codegen) lookup(name token) (arg, error) {
+	for i := len(g.scopes) - 1; i >= 0; i-- {
+		if v, ok := g.scopes[i][name.text]; ok {
+			return v, nil
+		}
+	}
+	if v, ok := g.globals[name.text]; ok {
+		return v, nil
+	}
+	return arg{}, errorAt(name, "undefined: %s", name.text)
+}
+
+func (g *codegen) statement(s stmt) error {
+	a := g.a
+	switch s := s.(type) {
+	case *varStmt:
+		scope := g.scopes[len(g.scopes)-1]
+		if _, dup := scope[s.name.text]; dup {
+			return errorAt(s.name, "%s redeclared", s.name.text)
+		}
+		v := slot(g.nextSlot)
+		g.nextSlot++
+		// The variable isn't in scope in its own initializer.
+		var init expr = &numberExpr{s.name, 0}
+		if s.init != nil {
+			init = s.init
+		}
+		if err := g.into(init, v, g.frameSize); err != nil {
+			return err
+		}
+		scope[s.name.text] = v
+	case *assignStmt:
+		v, err := g.lookup(s.name)
+		if err != nil {
+			return err
+		}
+		return g.into(s.value, v, g.frameSize)
+	case *ifStmt:
+		els, end := a.newLabel("else"), a.newLabel("endif")
+		if err := g.branchIfFalse(s.cond, els); err != nil {
+			return err
+		}
+		if err := g.block(s.then); err != nil {
+			return err
+		}
+		if s.els != nil {
+			a.jump(end)
+		}
+		a.mark(els)
+		if s.els != nil {
+			if err := g.block(s.els); err != nil {
+				return err
+			}
+			a.mark(end)
+		}
+	case *whileStmt:
+		l := loop{brk: a.newLabel("endwhile"), cont: a.newLabel("while")}
+		a.mark(l.cont)
+		if err := g.branchIfFalse(s.cond, l.brk); err != nil {
+			return err
+		}
+		g.loops = append(g.loops, l)
+		err := g.block(s.body)
+		g.loops = g.loops[:len(g.loops)-1]
+		if err != nil {
+			return err
+		}
+		a.jump(l.cont)
+		a.mark(l.brk)
+	case *returnStmt:
+		var value expr = &numberExpr{s.tok, 0}
+		if s.value != nil {
+			value = s.value
+		}
+		if err := g.into(value, slot(1), g.frameSize); err != nil {
+			return err
+		}
+		a.instr(6, imm(0), slot(0))
+	case *branchStmt:
+		if len(g.loops) == 0 {
+			return errorAt(s.tok, "%s outside a loop", s.tok.text)
+		}
+		l := g.loops[len(g.loops)-1]
+		if s.tok.text == "break" {
+			a.jump(l.brk)
+		} else {
+			a.jump(l.cont)
+		}
+	case *exprStmt:
+		if call, ok := s.x.(*callExpr); ok && call.name.text == "output" {
+			if len(call.args) != 1 {
+				return errorAt(call.name, "output takes 1 argument")
+			}
+			x, err := g.operand(call.args[0], g.frameSize)
+			if err != nil {
+				return err
+			}
+			a.instr(4, x)
+			return nil
+		}
+		return g.into(s.x, slot(g.frameSize), g.frameSize)
+	}
+	return nil
+}
+
+func (g *codegen) branchIfFalse(cond expr, label string) error {
+	x, err := g.operand(cond, g.frameSize)
+	if err != nil {
+		return err
+	}
+	g.a.instr(6, x, labelArg(label))
+	return nil
+}
+
+// operand returns a parameter holding the value of x, evaluating it into
+// frame[top] if it isn't a constant or variable. Cells from frame[top] up
+// may be overwritten.
+func (g *codegen) operand(x expr, top int) (arg, error) {
+	switch x := x.(type) {
+	case *numberExpr:
+		return imm(x.value), nil
+	case *nameExpr:
+		return g.lookup(x.tok)
+	}
+	return slot(top), g.into(x, slot(top), top)
+}
+
+// into evaluates x and stores it in dst, using cells from frame[top] up as
+// temporaries. dst is only written once the operands have been read, so it
+// may be one of them.
+func (g *codegen) into(x expr, dst arg, top int) error {
+	a := g.a
+	switch x := x.(type) {
+	case *numberExpr, *nameExpr:
+		v, err := g.operand(x, top)
+		if err != nil {
+			return err
+		}
+		a.instr(1, v, imm(0), dst)
+	case *unaryExpr:
+		v, err := g.operand(x.x, top)
+		if err != nil {
+			return err
+		}
+		if x.op.text == "-" {
+			a.instr(2, v, imm(-1), dst)
+		} else {
+			a.instr(8, v, imm(0), dst)
+		}
+	case *binaryExpr:
+		if x.op.text == "&&" || x.op.text == "||" {
+			return g.logical(x, dst, top)
+		}
+		l, err := g.operand(x.x, top)
+		if err != nil {
+			return err
+		}
+		r, err := g.operand(x.y, top+1)
+		if err != nil {
+			return err
+		}
+		switch x.op.text {
+		case "+":
+			a.instr(1, l, r, dst)
+		case "-":
+			if r.mode == modeImmediate {
+				a.instr(1, l, imm(-r.value), dst)
+			} else {
+				a.instr(2, r, imm(-1), slot(top+1))
+				a.instr(1, l, slot(top+1), dst)
+			}
+		case "*":
+			a.instr(2, l, r, dst)
+		case "<":
+			a.instr(7, l, r, dst)
+		case ">":
+			a.instr(7, r, l, dst)
+		case "<=":
+			a.instr(7, r, l, dst)
+			a.instr(8, dst, imm(0), dst)
+		case ">=":
+			a.instr(7, l, r, dst)
+			a.instr(8, dst, imm(0), dst)
+		case "==":
+			a.instr(8, l, r, dst)
+		case "!=":
+			a.instr(8, l, r, dst)
+			a.instr(8, dst, imm(0), dst)
+		}
+	case *callExpr:
+		return g.call(x, dst, top)
+	}
+	return nil
+}
+
+// logical evaluates && and || with short-circuiting, storing 1 or 0.
+func (g *codegen) logical(x *binaryExpr, dst arg, top int) error {
+	a := g.a
+	short, end := a.newLabel("short"), a.newLabel("end")
+	l, err := g.operand(x.x, top)
+	if err != nil {
+		return err
+	}
+	shortValue := 0
+	if x.op.text == "&&" {
+		a.instr(6, l, labelArg(short))
+	} else {
+		a.instr(5, l, labelArg(short))
+		shortValue = 1
+	}
+	r, err := g.operand(x.y, top)
+	if err != nil {
+		return err
+	}
+	a.instr(8, r, imm(0), dst)
+	a.instr(8, dst, imm(0), dst)
+	a.jump(end)
+	a.mark(short)
+	a.instr(1, imm(shortValue), imm(0), dst)
+	a.mark(end)
+	return nil
+}
+
+// call calls a function with its frame at frame[top].
+func (g *codegen) call(x *callExpr, dst arg, top int) error {
+	a := g.a
+	switch x.name.text {
+	case "input":
+		if len(x.args) != 0 {
+			return errorAt(x.name, "input takes no arguments")
+		}
+		a.instr(3, dst)
+		return nil
+	case "output":
+		return errorAt(x.name, "output doesn't return a value")
+	}
+	fn, ok := g.funcs[x.name.text]
+	if !ok {
+		return errorAt(x.name, "undefined function: %s", x.name.text)
+	}
+	if len(x.args) != len(fn.params) {
+		return errorAt(x.name, "%s takes %d arguments, not %d", fn.name.text, len(fn.params), len(x.args))
+	}
+	for i, arg := range x.args {
+		if err := g.into(arg, slot(top+1+i), top+1+i); err != nil {
+			return err
+		}
+	}
+	ret := a.newLabel("ret")
+	a.instr(9, imm(top))
+	a.instr(1, labelArg(ret), imm(0), slot(0))
+	a.jump("func." + fn.name.text)
+	a.mark(ret)
+	a.instr(9, imm(-top))
+	a.instr(1, slot(top+1), imm(0), dst)
+	return nil
+}
+
+func compile(args []string) error {
+	fs := flag.NewFlagSet("compile", flag.ExitOnError)
+	out := fs.String("o", "", "write the program to this file instead of stdout")
+	runIt := fs.Bool("run", false, "run the program and print its output instead")
+	in := fs.String("input", "", "comma separated input for -run")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: intcode compile [flags] <source>")
+	}
+
+	src, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	prg, err := compileSource(string(src))
+	if err != nil {
+		return fmt.Errorf("%s:%s", fs.Arg(0), err)
+	}
+	if *runIt {
+		inputs, err := parseInputs(*in)
+		if err != nil {
+			return err
+		}
+		c := newComputer(prg, newIntBuffer(), newIntBuffer())
+		for _, n := range inputs {
+			c.input.WriteInt(n)
+		}
+		if err := c.runUntilBlocked(); err != nil {
+			return err
+		}
+		for _, n := range c.output.Drain() {
+			fmt.Println(n)
+		}
+		if c.running {
+			return errors.New("program is waiting for input")
+		}
+		return nil
+	}
+
+	ints := make([]string, len(prg))
+	for i, n := range prg {
+		ints[i] = strconv.Itoa(n)
+	}
+	csv := strings.Join(ints, ",") + "\n"
+	if *out == "" {
+		_, err = os.Stdout.WriteString(csv)
+		return err
+	}
+	return ioutil.WriteFile(*out, []byte(csv), 0644)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCompileExamples(t *testing.T) {
+	for _, tt := range []struct {
+		file  string
+		input []int
+		want  []int
+	}{
+		// fib(5) down to fib(1), then how many calls fib took.
+		{"examples/fib.ic", []int{5}, []int{5, 3, 2, 1, 1, 33}},
+		// The primes below 20, then minus how many there are.
+		{"examples/primes.ic", []int{20}, []int{2, 3, 5, 7, 11, 13, 17, 19, -8}},
+	} {
+		src, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prg, err := compileSource(string(src))
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		got, _, _, err := runOnce(prg, tt.input, conformanceMaxSteps)
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if !equalInts(got, tt.want) {
+			t.Errorf("%s output %v, want %v", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		src, want string
+	}{
+		{"func output(x) {\n\treturn x;\n}\nfunc main() {\n\toutput(1);\n}\n", "1:6: output is a builtin"},
+		{"func input() {\n\treturn 1;\n}\nfunc main() {\n\toutput(input());\n}\n", "1:6: input is a builtin"},
+		{"func f() {\n\treturn 1;\n}\n", "no main function"},
+	} {
+		_, err := compileSource(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("compiling %q: got error %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"aoc2019/intcode/conformance"
+)
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+const conformanceMaxSteps = 1_000_000
+
+func sharedMachine(lenient bool) conformance.Interpreter {
+	return func(prg, input []int) ([]int, []int, error) {
+		c := newComputer(prg, newIntBuffer(), newIntBuffer())
+		c.lenient = lenient
+		for _, n := range input {
+			c.input.WriteInt(n)
+		}
+		err := c.runBudget(conformanceMaxSteps, time.Time{})
+		if err == nil && c.running {
+			err = errors.New("waiting for more input")
+		}
+		return c.output.Drain(), c.memory.ints(), err
+	}
+}
+
+// forkedMachine runs programs on a fork of the computer they were loaded
+// into, and checks the parent's memory wasn't changed by the fork.
+func forkedMachine(prg, input []int) ([]int, []int, error) {
+	parent := newComputer(prg, newIntBuffer(), newIntBuffer())
+	c := parent.fork(newIntBuffer(), newIntBuffer())
+	for _, n := range input {
+		c.input.WriteInt(n)
+	}
+	err := c.runBudget(conformanceMaxSteps, time.Time{})
+	if err == nil && c.running {
+		err = errors.New("waiting for more input")
+	}
+	output, memory := c.output.Drain(), c.memory.ints()
+	if err == nil && !equalInts(parent.memory.ints(), prg) {
+		err = errors.New("fork wrote to its parent's memory")
+	}
+	return output, memory, err
+}
+
+// interpreters are the machines the conformance command checks. Each day's
+// computer is checked by its own tests through conformance.Test.
+var interpreters = []conformance.Named{
+	{Name: "strict", Run: sharedMachine(false)},
+	{Name: "lenient", Run: sharedMachine(true)},
+	{Name: "fork", Run: forkedMachine},
+}
+
+func runConformance(args []string) error {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	only := fs.String("impl", "", "only check the named interpreter")
+	fs.Parse(args)
+
+	impls := interpreters
+	if *only != "" {
+		impls = nil
+		for _, impl := range interpreters {
+			if impl.Name == *only {
+				impls = append(impls, impl)
+			}
+		}
+		if len(impls) == 0 {
+			return fmt.Errorf("conformance: unknown interpreter %q", *only)
+		}
+	}
+	cases := conformance.Catalogue()
+	if !conformance.PrintMatrix(os.Stdout, cases, impls, conformance.Matrix(cases, impls)) {
+		return errors.New("conformance: some cases failed")
+	}
+	return nil
+}
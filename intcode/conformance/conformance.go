@@ -0,0 +1,198 @@
+// Package conformance checks intcode interpreters against a catalogue of
+// spec programs from the puzzles: the day 2 examples, the day 5 compare and
+// jump examples and the day 9 quine and large-number programs.
+//
+// The catalogue and the runner only depend on the Interpreter type, so any
+// implementation, like the intcode tool's machine or a day's own computer,
+// can be checked by wrapping it in an Interpreter.
+package conformance
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"text/tabwriter"
+)
+
+// An Interpreter runs a program to completion with the given input and
+// returns what it output and its final memory.
+type Interpreter func(prg, input []int) (output, memory []int, err error)
+
+// A Named interpreter is a column of the matrix.
+type Named struct {
+	Name string
+	Run  Interpreter
+}
+
+// A Case is a spec program with its expected results.
+type Case struct {
+	Name string
+	// Day is the puzzle that introduced the instructions the case needs.
+	Day     int
+	Program []int
+	Input   []int
+	// Output and Memory are checked when non-nil. Memory is compared
+	// against the start of the final memory, and any cells beyond it must
+	// be zero.
+	Output []int
+	Memory []int
+}
+
+func compareCase(name string, program []int, output ...int) Case {
+	return Case{Name: name, Day: 9, Program: program, Output: output}
+}
+
+// ioCases returns a case for each input to a day 5 program that reads one
+// value and outputs one value.
+func ioCases(name string, program []int, pairs ...[2]int) []Case {
+	var cases []Case
+	for _, p := range pairs {
+		cases = append(cases, Case{
+			Name:    fmt.Sprintf("%s(%d)", name, p[0]),
+			Day:     5,
+			Program: program,
+			Input:   []int{p[0]},
+			Output:  []int{p[1]},
+		})
+	}
+	return cases
+}
+
+// Catalogue returns the spec programs, oldest day first.
+func Catalogue() []Case {
+	quine := []int{109, 1, 204, -1, 1001, 100, 1, 100, 1008, 100, 16, 101, 1006, 101, 0, 99}
+	cases := []Case{
+		{Name: "day2/add", Day: 2, Program: []int{1, 0, 0, 0, 99}, Memory: []int{2, 0, 0, 0, 99}},
+		{Name: "day2/mul", Day: 2, Program: []int{2, 3, 0, 3, 99}, Memory: []int{2, 3, 0, 6, 99}},
+		{Name: "day2/mul-past-halt", Day: 2, Program: []int{2, 4, 4, 5, 99, 0}, Memory: []int{2, 4, 4, 5, 99, 9801}},
+		{Name: "day2/self-modify", Day: 2, Program: []int{1, 1, 1, 4, 99, 5, 6, 0, 99}, Memory: []int{30, 1, 1, 4, 2, 5, 6, 0, 99}},
+		{
+			Name:    "day2/example",
+			Day:     2,
+			Program: []int{1, 9, 10, 3, 2, 3, 11, 0, 99, 30, 40, 50},
+			Memory:  []int{3500, 9, 10, 70, 2, 3, 11, 0, 99, 30, 40, 50},
+		},
+		{Name: "day5/echo", Day: 5, Program: []int{3, 0, 4, 0, 99}, Input: []int{42}, Output: []int{42}},
+		{Name: "day5/modes", Day: 5, Program: []int{1002, 4, 3, 4, 33}, Memory: []int{1002, 4, 3, 4, 99}},
+		{Name: "day5/negative", Day: 5, Program: []int{1101, 100, -1, 4, 0}, Memory: []int{1101, 100, -1, 4, 99}},
+	}
+	cases = append(cases, ioCases("day5/eq-position", []int{3, 9, 8, 9, 10, 9, 4, 9, 99, -1, 8}, [2]int{8, 1}, [2]int{7, 0})...)
+	cases = append(cases, ioCases("day5/lt-position", []int{3, 9, 7, 9, 10, 9, 4, 9, 99, -1, 8}, [2]int{5, 1}, [2]int{8, 0})...)
+	cases = append(cases, ioCases("day5/eq-immediate", []int{3, 3, 1108, -1, 8, 3, 4, 3, 99}, [2]int{8, 1}, [2]int{9, 0})...)
+	cases = append(cases, ioCases("day5/lt-immediate", []int{3, 3, 1107, -1, 8, 3, 4, 3, 99}, [2]int{7, 1}, [2]int{8, 0})...)
+	cases = append(cases, ioCases("day5/jump-position",
+		[]int{3, 12, 6, 12, 15, 1, 13, 14, 13, 4, 13, 99, -1, 0, 1, 9}, [2]int{0, 0}, [2]int{5, 1})...)
+	cases = append(cases, ioCases("day5/jump-immediate",
+		[]int{3, 3, 1105, -1, 9, 1101, 0, 0, 12, 4, 12, 99, 1}, [2]int{0, 0}, [2]int{5, 1})...)
+	cases = append(cases, ioCases("day5/compare-8", []int{
+		3, 21, 1008, 21, 8, 20, 1005, 20, 22, 107, 8, 21, 20, 1006, 20, 31,
+		1106, 0, 36, 98, 0, 0, 1002, 21, 125, 20, 4, 20, 1105, 1, 46, 104,
+		999, 1105, 1, 46, 1101, 1000, 1, 20, 4, 20, 1105, 1, 46, 98, 99,
+	}, [2]int{7, 999}, [2]int{8, 1000}, [2]int{9, 1001})...)
+	cases = append(cases,
+		compareCase("day9/quine", quine, quine...),
+		compareCase("day9/large-mul", []int{1102, 34915192, 34915192, 7, 4, 7, 99, 0}, 1219070632396864),
+		compareCase("day9/large-out", []int{104, 1125899906842624, 99}, 1125899906842624),
+	)
+	return cases
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Check runs the case on a copy of its program and returns why it failed,
+// or nil if it passed. A panicking interpreter fails the case.
+func (tc *Case) Check(impl Interpreter) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	output, memory, err := impl(append([]int{}, tc.Program...), tc.Input)
+	if err != nil {
+		return err
+	}
+	if tc.Output != nil && !equalInts(output, tc.Output) {
+		return fmt.Errorf("output %v, want %v", output, tc.Output)
+	}
+	if tc.Memory != nil {
+		if len(memory) < len(tc.Memory) || !equalInts(memory[:len(tc.Memory)], tc.Memory) {
+			return fmt.Errorf("memory %v, want %v", memory, tc.Memory)
+		}
+		for i := len(tc.Memory); i < len(memory); i++ {
+			if memory[i] != 0 {
+				return fmt.Errorf("memory %v, want %v", memory, tc.Memory)
+			}
+		}
+	}
+	return nil
+}
+
+// Matrix runs every case against every interpreter. results[i][j] is the
+// result of case i on interpreter j, nil if it passed.
+func Matrix(cases []Case, impls []Named) [][]error {
+	results := make([][]error, len(cases))
+	for i := range cases {
+		results[i] = make([]error, len(impls))
+		for j, impl := range impls {
+			results[i][j] = cases[i].Check(impl.Run)
+		}
+	}
+	return results
+}
+
+// PrintMatrix writes a pass/fail table followed by the details of each
+// failure, and reports whether everything passed.
+func PrintMatrix(w io.Writer, cases []Case, impls []Named, results [][]error) bool {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "case")
+	for _, impl := range impls {
+		fmt.Fprintf(tw, "\t%s", impl.Name)
+	}
+	fmt.Fprintln(tw)
+	var failures []string
+	for i, tc := range cases {
+		fmt.Fprint(tw, tc.Name)
+		for j, err := range results[i] {
+			if err != nil {
+				fmt.Fprint(tw, "\tFAIL")
+				failures = append(failures, fmt.Sprintf("%s on %s: %s", tc.Name, impls[j].Name, err))
+			} else {
+				fmt.Fprint(tw, "\tpass")
+			}
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	if len(failures) > 0 {
+		fmt.Fprintf(w, "\n%s\n", strings.Join(failures, "\n"))
+	}
+	return len(failures) == 0
+}
+
+// Test runs the catalogue as subtests of t, skipping cases that need
+// instructions from after day, for interpreters that only implement the
+// puzzles up to then.
+func Test(t *testing.T, day int, impl Interpreter) {
+	for _, tc := range Catalogue() {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			if tc.Day > day {
+				t.Skipf("needs day %d's instructions", tc.Day)
+			}
+			if err := tc.Check(impl); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package conformance
+
+import "testing"
+
+// A machine that only copies its program fails every case that checks
+// output or changes memory.
+func TestCheckCatchesWrongResults(t *testing.T) {
+	idle := func(prg, input []int) ([]int, []int, error) { return nil, prg, nil }
+	for _, tc := range Catalogue() {
+		if err := tc.Check(idle); err == nil {
+			t.Errorf("%s passed on a machine that does nothing", tc.Name)
+		}
+	}
+}
+
+func TestCheckRecoversPanics(t *testing.T) {
+	tc := Catalogue()[0]
+	err := tc.Check(func(prg, input []int) ([]int, []int, error) { panic("boom") })
+	if err == nil || err.Error() != "panic: boom" {
+		t.Errorf("Check = %v, want panic: boom", err)
+	}
+}
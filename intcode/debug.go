@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const debugHelp = `commands:
+  break <expr>        stop before an instruction when expr is true; a bare
+                      number n is short for pc==n
+  rwatch <addr>       stop after an instruction reads mem[addr]
+  wwatch <addr>       stop after an instruction writes mem[addr]
+  watch <expr>        show expr whenever the program stops
+  delete <id>         remove a breakpoint, watchpoint or watch
+  info                list breakpoints, watchpoints and watches
+  step [n]            run n instructions (default 1)
+  continue            run until a breakpoint, watchpoint, halt or input wait
+  print <expr>        evaluate expr
+  input <n>...        queue input values
+  quit`
+
+type breakpoint struct {
+	id   int
+	cond *expression
+}
+
+type watchpoint struct {
+	id    int
+	addr  int
+	write bool
+}
+
+func (wp *watchpoint) String() string {
+	kind := "read"
+	if wp.write {
+		kind = "write"
+	}
+	return fmt.Sprintf("watchpoint %d: %s mem[%d]", wp.id, kind, wp.addr)
+}
+
+type watch struct {
+	id   int
+	expr *expression
+}
+
+type debugger struct {
+	c   *computer
+	env *exprEnv
+	w   io.Writer
+
+	nextID      int
+	breakpoints []*breakpoint
+	watchpoints []*watchpoint
+	watches     []*watch
+
+	// stop is set by hooks when a watchpoint is hit.
+	stop string
+	// stoppedAt is the breakpoint the program last stopped at and where,
+	// so running on from there doesn't stop at it again straight away. An
+	// id of zero means it didn't stop at a breakpoint.
+	stoppedAt struct{ pc, id int }
+}
+
+func newDebugger(c *computer, w io.Writer) *debugger {
+	d := &debugger{
+		c:      c,
+		env:    &exprEnv{c: c},
+		w:      w,
+		nextID: 1,
+	}
+	c.observe(&hooks{
+		memoryRead: func(c *computer, addr, n int) {
+			d.hitWatchpoint(addr, false, fmt.Sprintf("read mem[%d] = %d", addr, n))
+		},
+		memoryWrite: func(c *computer, addr, old, new int) {
+			d.hitWatchpoint(addr, true, fmt.Sprintf("write mem[%d] %d -> %d", addr, old, new))
+		},
+		inputConsumed: func(c *computer, n int) {
+			d.env.lastInput = n
+		},
+		outputProduced: func(c *computer, n int) {
+			d.env.lastOutput = n
+			fmt.Fprintf(d.w, "output %d\n", n)
+		},
+	})
+	return d
+}
+
+func (d *debugger) hitWatchpoint(addr int, write bool, desc string) {
+	for _, wp := range d.watchpoints {
+		if wp.addr == addr && wp.write == write {
+			d.stop = fmt.Sprintf("watchpoint %d: %s", wp.id, desc)
+		}
+	}
+}
+
+// breakpointHit returns a description and the id of the first breakpoint
+// other than skip whose condition holds, or "" if there isn't one.
+func (d *debugger) breakpointHit(skip int) (string, int) {
+	for _, bp := range d.breakpoints {
+		if bp.id == skip {
+			continue
+		}
+		n, err := bp.cond.evaluate(d.env)
+		if err != nil {
+			return fmt.Sprintf("breakpoint %d: %s", bp.id, err), bp.id
+		}
+		if n != 0 {
+			return fmt.Sprintf("breakpoint %d: %s", bp.id, bp.cond.src), bp.id
+		}
+	}
+	return "", 0
+}
+
+// run executes up to n instructions, or until something stops the program
+// if n is negative, and returns why it stopped.
+func (d *debugger) run(n int) (reason string) {
+	defer func() {
+		if r := recover(); r != nil {
+			reason = d.c.fail(fmt.Errorf("error at pc %d: %v", d.c.instrPC, r)).Error()
+		}
+	}()
+	last := d.stoppedAt
+	d.stoppedAt.id = 0
+	for i := 0; n < 0 || i < n; i++ {
+		if !d.c.running {
+			return "halted"
+		}
+		waiting, err := d.c.waitingForInput()
+		if err != nil {
+			return d.c.fail(fmt.Errorf("error at pc %d: %v", d.c.pc, err)).Error()
+		}
+		if waiting {
+			return "waiting for input"
+		}
+		// Don't stop at the breakpoint the program is already stopped at.
+		skip := 0
+		if i == 0 && d.c.pc == last.pc {
+			skip = last.id
+		}
+		if hit, id := d.breakpointHit(skip); hit != "" {
+			d.stoppedAt.pc, d.stoppedAt.id = d.c.pc, id
+			return hit
+		}
+		d.stop = ""
+		d.c.step()
+		if d.stop != "" {
+			return d.stop
+		}
+	}
+	if !d.c.running {
+		return "halted"
+	}
+	return ""
+}
+
+func (d *debugger) showState(reason string) {
+	if reason != "" {
+		fmt.Fprintln(d.w, reason)
+	}
+	fmt.Fprintf(d.w, "pc=%d rb=%d steps=%d", d.c.pc, d.c.relBase, d.c.steps)
+	if d.c.running {
+		if in, ok := d.c.disassemble(d.c.pc); ok {
+			fmt.Fprintf(d.w, "  next: %s", in)
+		}
+	}
+	fmt.Fprintln(d.w)
+	for _, wt := range d.watches {
+		if n, err := wt.expr.evaluate(d.env); err != nil {
+			fmt.Fprintf(d.w, "  %d: %s\n", wt.id, err)
+		} else {
+			fmt.Fprintf(d.w, "  %d: %s = %d\n", wt.id, wt.expr.src, n)
+		}
+	}
+}
+
+func (d *debugger) evalArg(arg string) (int, error) {
+	e, err := parseExpression(arg)
+	if err != nil {
+		return 0, err
+	}
+	return e.evaluate(d.env)
+}
+
+// execute runs one debugger command and reports whether to keep going.
+func (d *debugger) execute(line string) (bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true, nil
+	}
+	cmd := fields[0]
+	arg := strings.TrimSpace(strings.TrimPrefix(line, cmd))
+	switch cmd {
+	case "break", "b":
+		if _, err := strconv.Atoi(arg); err == nil {
+			arg = "pc==" + arg
+		}
+		cond, err := parseExpression(arg)
+		if err != nil {
+			return true, err
+		}
+		d.breakpoints = append(d.breakpoints, &breakpoint{id: d.nextID, cond: cond})
+		fmt.Fprintf(d.w, "breakpoint %d: %s\n", d.nextID, cond.src)
+		d.nextID++
+	case "rwatch", "wwatch":
+		addr, err := d.evalArg(arg)
+		if err != nil {
+			return true, err
+		}
+		wp := &watchpoint{id: d.nextID, addr: addr, write: cmd == "wwatch"}
+		d.watchpoints = append(d.watchpoints, wp)
+		fmt.Fprintln(d.w, wp)
+		d.nextID++
+	case "watch", "w":
+		e, err := parseExpression(arg)
+		if err != nil {
+			return true, err
+		}
+		d.watches = append(d.watches, &watch{id: d.nextID, expr: e})
+		fmt.Fprintf(d.w, "watch %d: %s\n", d.nextID, e.src)
+		d.nextID++
+	case "delete", "d":
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return true, fmt.Errorf("bad id %q", arg)
+		}
+		if !d.delete(id) {
+			return true, fmt.Errorf("nothing with id %d", id)
+		}
+	case "info", "i":
+		for _, bp := range d.breakpoints {
+			fmt.Fprintf(d.w, "breakpoint %d: %s\n", bp.id, bp.cond.src)
+		}
+		for _, wp := range d.watchpoints {
+			fmt.Fprintln(d.w, wp)
+		}
+		for _, wt := range d.watches {
+			fmt.Fprintf(d.w, "watch %d: %s\n", wt.id, wt.expr.src)
+		}
+	case "step", "s":
+		n := 1
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+				return true, fmt.Errorf("bad step count %q", arg)
+			}
+		}
+		d.showState(d.run(n))
+	case "continue", "c":
+		d.showState(d.run(-1))
+	case "print", "p":
+		n, err := d.evalArg(arg)
+		if err != nil {
+			return true, err
+		}
+		fmt.Fprintln(d.w, n)
+	case "input":
+		ints, err := parseInputs(arg)
+		if err != nil {
+			return true, err
+		}
+		for _, n := range ints {
+			d.c.input.WriteInt(n)
+		}
+	case "quit", "q":
+		return false, nil
+	case "help", "h":
+		fmt.Fprintln(d.w, debugHelp)
+	default:
+		return true, fmt.Errorf("unknown command %q; try help", cmd)
+	}
+	return true, nil
+}
+
+func (d *debugger) delete(id int) bool {
+	for i, bp := range d.breakpoints {
+		if bp.id == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return true
+		}
+	}
+	for i, wp := range d.watchpoints {
+		if wp.id == id {
+			d.watchpoints = append(d.watchpoints[:i], d.watchpoints[i+1:]...)
+			return true
+		}
+	}
+	for i, wt := range d.watches {
+		if wt.id == id {
+			d.watches = append(d.watches[:i], d.watches[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func debug(args []string) error {
+	fs := flag.NewFlagSet("debug", flag.ExitOnError)
+	in := fs.String("input", "", "comma separated program input")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: intcode debug [flags] <program>")
+	}
+
+	prg, err := loadProgram(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	inputs, err := parseInputs(*in)
+	if err != nil {
+		return err
+	}
+	c := newComputer(prg, newIntBuffer(), newIntBuffer())
+	for _, n := range inputs {
+		c.input.WriteInt(n)
+	}
+	d := newDebugger(c, os.Stdout)
+	d.showState("")
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("(intcode) ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+		more, err := d.execute(scanner.Text())
+		if err != nil {
+			fmt.Println(err)
+		}
+		if !more {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var twoStores = []int{1101, 1, 1, 10, 1101, 2, 2, 11, 99}
+
+func TestBreakAtStart(t *testing.T) {
+	var sb strings.Builder
+	d := newDebugger(newComputer(twoStores, newIntBuffer(), newIntBuffer()), &sb)
+	d.execute("break 0")
+	if got := d.run(-1); got != "breakpoint 1: pc==0" {
+		t.Errorf("first continue stopped with %q, want breakpoint 1", got)
+	}
+	if got := d.run(-1); got != "halted" {
+		t.Errorf("second continue stopped with %q, want halted", got)
+	}
+}
+
+// A breakpoint at the pc a watchpoint stopped at still stops the program.
+func TestBreakAfterWatchpoint(t *testing.T) {
+	var sb strings.Builder
+	d := newDebugger(newComputer(twoStores, newIntBuffer(), newIntBuffer()), &sb)
+	d.execute("wwatch 10")
+	d.execute("break pc==4")
+	if got := d.run(-1); got != "watchpoint 1: write mem[10] 0 -> 2" {
+		t.Fatalf("first continue stopped with %q, want watchpoint 1", got)
+	}
+	if got := d.run(-1); got != "breakpoint 2: pc==4" {
+		t.Errorf("second continue stopped with %q, want breakpoint 2", got)
+	}
+}
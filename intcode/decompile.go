@@ -0,0 +1,711 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The decompiler recovers structure from the idioms compiled intcode
+// programs use:
+//
+//   - A call stores its return address in a relative-mode cell, usually
+//     with an add of two immediates, and then jumps unconditionally to the
+//     function. The instruction after the jump is where the call returns.
+//   - A function returns by jumping unconditionally through a relative-mode
+//     cell holding that return address.
+//   - A rel instruction with an immediate sets up or tears down a frame.
+//   - Conditional jumps to earlier addresses close loops, and conditional
+//     jumps to later addresses skip the body of an if.
+//
+// Relative-mode cells are shown as frame[n], where n is the offset from the
+// relative base at the start of the function, so the same cell has the same
+// name throughout a function even as rel instructions move the base.
+
+type operand struct {
+	mode  mode
+	value int
+}
+
+type instr struct {
+	addr int
+	code int
+	args []operand
+}
+
+func (in *instr) end() int {
+	return in.addr + 1 + len(in.args)
+}
+
+// String disassembles the instruction, writing position operands as [n],
+// relative operands as [rb+n] and immediates as plain numbers.
+func (in *instr) String() string {
+	var sb strings.Builder
+	sb.WriteString(signatures[in.code].name)
+	for i, arg := range in.args {
+		if i == 0 {
+			sb.WriteString(" ")
+		} else {
+			sb.WriteString(", ")
+		}
+		switch arg.mode {
+		case modeImmediate:
+			sb.WriteString(strconv.Itoa(arg.value))
+		case modeRelative:
+			fmt.Fprintf(&sb, "[rb%+d]", arg.value)
+		default:
+			fmt.Fprintf(&sb, "[%d]", arg.value)
+		}
+	}
+	return sb.String()
+}
+
+func (in *instr) isJump() bool {
+	return in.code == 5 || in.code == 6
+}
+
+// taken reports whether a jump is always or never taken because its
+// condition is an immediate.
+func (in *instr) taken() (always, never bool) {
+	cond := in.args[0]
+	if cond.mode != modeImmediate {
+		return false, false
+	}
+	if (in.code == 5) == (cond.value != 0) {
+		return true, false
+	}
+	return false, true
+}
+
+// target returns the address a jump goes to when it's known statically.
+func (in *instr) target() (int, bool) {
+	t := in.args[1]
+	return t.value, t.mode == modeImmediate
+}
+
+func decodeAt(prg []int, addr int) (*instr, bool) {
+	if addr < 0 || addr >= len(prg) {
+		return nil, false
+	}
+	code, modes, err := decode(prg[addr], false)
+	if err != nil {
+		return nil, false
+	}
+	sig := signatures[code]
+	if addr+sig.params >= len(prg) {
+		return nil, false
+	}
+	modes = fillModes(modes, sig.params)
+	in := &instr{addr: addr, code: code}
+	for i := 0; i < sig.params; i++ {
+		in.args = append(in.args, operand{mode: modes[i], value: prg[addr+1+i]})
+	}
+	return in, true
+}
+
+type analysis struct {
+	prg    []int
+	instrs map[int]*instr
+	// calls maps the address of each call's jump to the function called.
+	calls map[int]int
+	// pushes holds the addresses of instructions storing a return address.
+	pushes map[int]bool
+	funcs  []*function
+}
+
+type function struct {
+	entry  int
+	instrs map[int]*instr
+	// rbDelta is how far the relative base has moved from its value at
+	// entry when each instruction runs, if that can be determined.
+	rbDelta map[int]int
+	blocks  []*block
+	// loops maps each loop header to the last block that jumps back to it.
+	loops map[int]*block
+}
+
+type block struct {
+	start  int
+	end    int
+	instrs []*instr
+	// term is the final instruction if it transfers control somewhere other
+	// than the next instruction. Calls aren't terminators since they return
+	// to the following instruction.
+	term *instr
+}
+
+func analyze(prg []int) *analysis {
+	a := &analysis{
+		prg:    prg,
+		instrs: make(map[int]*instr),
+		calls:  make(map[int]int),
+		pushes: make(map[int]bool),
+	}
+	entries := map[int]bool{0: true}
+	work := []int{0}
+	var prev *instr
+	for len(work) > 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+		prev = nil
+		for {
+			if _, seen := a.instrs[addr]; seen {
+				break
+			}
+			in, ok := decodeAt(prg, addr)
+			if !ok {
+				break
+			}
+			a.instrs[addr] = in
+			if in.code == 99 {
+				break
+			}
+			if in.isJump() {
+				always, never := in.taken()
+				t, known := in.target()
+				if known && !never {
+					if always && isReturnPush(prev, in.end()) {
+						a.calls[in.addr] = t
+						a.pushes[prev.addr] = true
+						entries[t] = true
+					}
+					work = append(work, t)
+				}
+				if _, isCall := a.calls[in.addr]; always && !isCall {
+					break
+				}
+			}
+			prev = in
+			addr = in.end()
+		}
+	}
+
+	var sorted []int
+	for entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Ints(sorted)
+	for _, entry := range sorted {
+		if _, ok := a.instrs[entry]; ok {
+			a.funcs = append(a.funcs, a.function(entry))
+		}
+	}
+	return a
+}
+
+// isReturnPush reports whether in stores the constant ret to a
+// relative-mode cell.
+func isReturnPush(in *instr, ret int) bool {
+	if in == nil || (in.code != 1 && in.code != 2) || in.args[2].mode != modeRelative {
+		return false
+	}
+	x, y := in.args[0], in.args[1]
+	if x.mode != modeImmediate || y.mode != modeImmediate {
+		return false
+	}
+	if in.code == 1 {
+		return x.value+y.value == ret
+	}
+	return x.value*y.value == ret
+}
+
+// successors returns the addresses control can reach from in without
+// leaving the function, treating calls as returning to the next instruction.
+func (a *analysis) successors(in *instr) []int {
+	switch {
+	case in.code == 99:
+		return nil
+	case in.isJump():
+		if _, ok := a.calls[in.addr]; ok {
+			return []int{in.end()}
+		}
+		always, never := in.taken()
+		t, known := in.target()
+		var succ []int
+		if !always {
+			succ = append(succ, in.end())
+		}
+		if known && !never {
+			succ = append(succ, t)
+		}
+		return succ
+	default:
+		return []int{in.end()}
+	}
+}
+
+func (a *analysis) function(entry int) *function {
+	fn := &function{
+		entry:   entry,
+		instrs:  make(map[int]*instr),
+		rbDelta: make(map[int]int),
+		loops:   make(map[int]*block),
+	}
+	unknown := make(map[int]bool)
+	type state struct {
+		addr    int
+		delta   int
+		unknown bool
+	}
+	work := []state{{addr: entry}}
+	for len(work) > 0 {
+		s := work[len(work)-1]
+		work = work[:len(work)-1]
+		in, ok := a.instrs[s.addr]
+		if !ok {
+			continue
+		}
+		if _, seen := fn.instrs[s.addr]; seen {
+			if unknown[s.addr] || !s.unknown && s.delta == fn.rbDelta[s.addr] {
+				continue
+			}
+			// Control reaches the instruction with the base moved by a
+			// different amount, like a loop that runs a rel each time
+			// round, so the base isn't known there or anywhere after it.
+			s.unknown = true
+		}
+		fn.instrs[s.addr] = in
+		fn.rbDelta[s.addr] = s.delta
+		if s.unknown {
+			unknown[s.addr] = true
+		}
+		next := s
+		if in.code == 9 {
+			if in.args[0].mode == modeImmediate {
+				next.delta += in.args[0].value
+			} else {
+				next.unknown = true
+			}
+		}
+		for _, addr := range a.successors(in) {
+			next.addr = addr
+			work = append(work, next)
+		}
+	}
+	for addr := range unknown {
+		delete(fn.rbDelta, addr)
+	}
+	a.buildBlocks(fn)
+	return fn
+}
+
+func (a *analysis) buildBlocks(fn *function) {
+	leaders := map[int]bool{fn.entry: true}
+	for _, in := range fn.instrs {
+		if _, isCall := a.calls[in.addr]; isCall {
+			leaders[in.end()] = true
+			continue
+		}
+		if in.code == 99 || in.isJump() {
+			leaders[in.end()] = true
+		}
+		if in.isJump() {
+			if t, ok := in.target(); ok {
+				leaders[t] = true
+			}
+		}
+	}
+	var addrs []int
+	for addr := range fn.instrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+
+	var b *block
+	for _, addr := range addrs {
+		in := fn.instrs[addr]
+		if b == nil || leaders[addr] || b.end != addr {
+			b = &block{start: addr}
+			fn.blocks = append(fn.blocks, b)
+		}
+		b.instrs = append(b.instrs, in)
+		b.end = in.end()
+		_, isCall := a.calls[in.addr]
+		if in.code == 99 || (in.isJump() && !isCall) {
+			if in.code == 99 {
+				b.term = in
+			} else if _, never := in.taken(); !never {
+				b.term = in
+			}
+			b = nil
+		}
+	}
+
+	for _, b := range fn.blocks {
+		if b.term == nil || !b.term.isJump() {
+			continue
+		}
+		t, ok := b.term.target()
+		if !ok || t > b.term.addr {
+			continue
+		}
+		if latch, ok := fn.loops[t]; !ok || latch.start < b.start {
+			fn.loops[t] = b
+		}
+	}
+}
+
+type line struct {
+	depth int
+	text  string
+	// label is the address a label line names, or -1 for ordinary lines.
+	label int
+}
+
+type loopContext struct {
+	header int
+	exit   int
+}
+
+type emitter struct {
+	a          *analysis
+	fn         *function
+	lines      []line
+	gotos      map[int]bool
+	suppressed map[int]bool
+	active     map[int]bool
+	loops      []loopContext
+}
+
+func (e *emitter) emit(depth int, format string, args ...interface{}) {
+	e.lines = append(e.lines, line{depth: depth, text: fmt.Sprintf(format, args...), label: -1})
+}
+
+func (e *emitter) funcName(addr int) string {
+	if addr == 0 {
+		return "main"
+	}
+	return fmt.Sprintf("fn_%d", addr)
+}
+
+func (e *emitter) operand(in *instr, op operand) string {
+	switch op.mode {
+	case modeImmediate:
+		return strconv.Itoa(op.value)
+	case modeRelative:
+		delta, ok := e.fn.rbDelta[in.addr]
+		if !ok {
+			return fmt.Sprintf("mem[rb%+d]", op.value)
+		}
+		return fmt.Sprintf("frame[%d]", op.value+delta)
+	default:
+		return fmt.Sprintf("mem[%d]", op.value)
+	}
+}
+
+// condition returns the condition under which a jump is taken.
+func (e *emitter) condition(in *instr) string {
+	c := e.operand(in, in.args[0])
+	if in.code == 6 {
+		return "!" + c
+	}
+	return c
+}
+
+func negate(cond string) string {
+	if strings.HasPrefix(cond, "!") {
+		return cond[1:]
+	}
+	return "!" + cond
+}
+
+func (e *emitter) statement(in *instr) (string, bool) {
+	if e.a.pushes[in.addr] {
+		return "", false
+	}
+	if callee, ok := e.a.calls[in.addr]; ok {
+		return e.funcName(callee) + "()", true
+	}
+	arg := func(i int) string {
+		return e.operand(in, in.args[i])
+	}
+	switch in.code {
+	case 1:
+		x, y := in.args[0], in.args[1]
+		switch {
+		case x.mode == modeImmediate && x.value == 0:
+			return fmt.Sprintf("%s = %s", arg(2), arg(1)), true
+		case y.mode == modeImmediate && y.value == 0:
+			return fmt.Sprintf("%s = %s", arg(2), arg(0)), true
+		case y.mode == modeImmediate && y.value < 0:
+			return fmt.Sprintf("%s = %s - %d", arg(2), arg(0), -y.value), true
+		}
+		return fmt.Sprintf("%s = %s + %s", arg(2), arg(0), arg(1)), true
+	case 2:
+		x, y := in.args[0], in.args[1]
+		switch {
+		case x.mode == modeImmediate && x.value == 1:
+			return fmt.Sprintf("%s = %s", arg(2), arg(1)), true
+		case y.mode == modeImmediate && y.value == 1:
+			return fmt.Sprintf("%s = %s", arg(2), arg(0)), true
+		case y.mode == modeImmediate && y.value == -1:
+			return fmt.Sprintf("%s = -%s", arg(2), arg(0)), true
+		}
+		return fmt.Sprintf("%s = %s * %s", arg(2), arg(0), arg(1)), true
+	case 3:
+		return fmt.Sprintf("%s = input()", arg(0)), true
+	case 4:
+		return fmt.Sprintf("output(%s)", arg(0)), true
+	case 7:
+		return fmt.Sprintf("%s = %s < %s", arg(2), arg(0), arg(1)), true
+	case 8:
+		return fmt.Sprintf("%s = %s == %s", arg(2), arg(0), arg(1)), true
+	case 9:
+		if x := in.args[0]; x.mode == modeImmediate && x.value < 0 {
+			return fmt.Sprintf("rb -= %d", -x.value), true
+		}
+		return fmt.Sprintf("rb += %s", arg(0)), true
+	case 99:
+		return "halt()", true
+	}
+	// Jumps that are never taken.
+	return "", false
+}
+
+func (e *emitter) emitStatements(b *block, depth int) {
+	for _, in := range b.instrs {
+		if in == b.term {
+			continue
+		}
+		if s, ok := e.statement(in); ok {
+			e.emit(depth, "%s", s)
+		}
+	}
+}
+
+// transfer describes an unstructured jump to t from inside the current
+// loops, if it has a structured equivalent.
+func (e *emitter) transfer(t int) string {
+	if len(e.loops) > 0 {
+		loop := e.loops[len(e.loops)-1]
+		switch t {
+		case loop.header:
+			return "continue"
+		case loop.exit:
+			return "break"
+		}
+	}
+	e.gotos[t] = true
+	return fmt.Sprintf("goto L%d", t)
+}
+
+func (e *emitter) blockIndex(addr int) int {
+	return sort.Search(len(e.fn.blocks), func(i int) bool {
+		return e.fn.blocks[i].start >= addr
+	})
+}
+
+// blockEndingAt returns the block that ends at addr and starts within
+// [start, addr).
+func (e *emitter) blockEndingAt(start, addr int) *block {
+	for _, b := range e.fn.blocks {
+		if b.end == addr && b.start >= start {
+			return b
+		}
+	}
+	return nil
+}
+
+func (e *emitter) emitRange(start, end, depth int) {
+	i := e.blockIndex(start)
+	for i < len(e.fn.blocks) && e.fn.blocks[i].start < end {
+		b := e.fn.blocks[i]
+		e.lines = append(e.lines, line{depth: depth, label: b.start})
+		if latch, ok := e.fn.loops[b.start]; ok && latch.end <= end && !e.active[b.start] {
+			e.emitLoop(b, latch, depth)
+			i = e.blockIndex(latch.end)
+			continue
+		}
+		e.emitStatements(b, depth)
+		next := e.emitTerminator(b, end, depth)
+		if next >= 0 {
+			i = e.blockIndex(next)
+		} else {
+			i++
+		}
+	}
+}
+
+// emitTerminator emits a block's final control transfer and returns the
+// address emission should continue from, or -1 to continue with the next
+// block.
+func (e *emitter) emitTerminator(b *block, end, depth int) int {
+	in := b.term
+	if in == nil || e.suppressed[in.addr] {
+		return -1
+	}
+	if in.code == 99 {
+		e.emit(depth, "halt()")
+		return -1
+	}
+	always, _ := in.taken()
+	t, known := in.target()
+	if !known {
+		var s string
+		if in.args[1].mode == modeRelative {
+			s = "return"
+		} else {
+			s = "goto *" + e.operand(in, in.args[1])
+		}
+		if always {
+			e.emit(depth, "%s", s)
+		} else {
+			e.emit(depth, "if (%s) %s", e.condition(in), s)
+		}
+		return -1
+	}
+	if always {
+		if t == b.end && t < end {
+			return -1
+		}
+		e.emit(depth, "%s", e.transfer(t))
+		return -1
+	}
+
+	inLoop := len(e.loops) > 0
+	if inLoop {
+		loop := e.loops[len(e.loops)-1]
+		if t == loop.header || t == loop.exit {
+			e.emit(depth, "if (%s) %s", e.condition(in), e.transfer(t))
+			return -1
+		}
+	}
+	if t <= b.end || t > end {
+		e.emit(depth, "if (%s) %s", e.condition(in), e.transfer(t))
+		return -1
+	}
+
+	// A forward conditional jump skips the then branch. If the then branch
+	// ends by jumping further forward, what it jumps over is the else branch.
+	e.emit(depth, "if (%s) {", negate(e.condition(in)))
+	last := e.blockEndingAt(b.end, t)
+	if last != nil && last.term != nil && last.term.isJump() {
+		always, _ := last.term.taken()
+		u, known := last.term.target()
+		if always && known && u > t && u <= end {
+			e.suppressed[last.term.addr] = true
+			e.emitRange(b.end, t, depth+1)
+			e.emit(depth, "} else {")
+			e.emitRange(t, u, depth+1)
+			e.emit(depth, "}")
+			return u
+		}
+	}
+	e.emitRange(b.end, t, depth+1)
+	e.emit(depth, "}")
+	return t
+}
+
+func (e *emitter) emitLoop(header, latch *block, depth int) {
+	exit := latch.end
+	e.active[header.start] = true
+	e.loops = append(e.loops, loopContext{header: header.start, exit: exit})
+	defer func() {
+		e.loops = e.loops[:len(e.loops)-1]
+		delete(e.active, header.start)
+	}()
+
+	back := latch.term
+	e.suppressed[back.addr] = true
+	if always, _ := back.taken(); !always {
+		e.emit(depth, "do {")
+		e.emitRange(header.start, exit, depth+1)
+		e.emit(depth, "} while (%s)", e.condition(back))
+		return
+	}
+
+	test := header.term
+	if test != nil && test != back && len(header.instrs) == 1 && test.isJump() {
+		if t, ok := test.target(); ok && t == exit {
+			e.suppressed[test.addr] = true
+			e.emit(depth, "while (%s) {", negate(e.condition(test)))
+			e.emitRange(header.end, exit, depth+1)
+			e.emit(depth, "}")
+			return
+		}
+	}
+	e.emit(depth, "while (true) {")
+	e.emitRange(header.start, exit, depth+1)
+	e.emit(depth, "}")
+}
+
+func (a *analysis) decompileFunction(w io.Writer, fn *function) {
+	e := &emitter{
+		a:          a,
+		fn:         fn,
+		gotos:      make(map[int]bool),
+		suppressed: make(map[int]bool),
+		active:     make(map[int]bool),
+	}
+	first := fn.blocks[0].start
+	if first != fn.entry {
+		e.emit(1, "goto L%d", fn.entry)
+		e.gotos[fn.entry] = true
+	}
+	e.emitRange(first, fn.blocks[len(fn.blocks)-1].end, 1)
+
+	fmt.Fprintf(w, "func %s() { // %d\n", e.funcName(fn.entry), fn.entry)
+	for _, l := range e.lines {
+		if l.label >= 0 {
+			if e.gotos[l.label] {
+				fmt.Fprintf(w, "%sL%d:\n", strings.Repeat("\t", l.depth-1), l.label)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%s%s\n", strings.Repeat("\t", l.depth), l.text)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// dataRanges returns the ranges of cells that aren't part of any reachable
+// instruction.
+func (a *analysis) dataRanges() [][2]int {
+	code := make([]bool, len(a.prg))
+	for _, in := range a.instrs {
+		for i := in.addr; i < in.end(); i++ {
+			code[i] = true
+		}
+	}
+	var ranges [][2]int
+	for i := 0; i < len(code); i++ {
+		if code[i] {
+			continue
+		}
+		j := i
+		for j < len(code) && !code[j] {
+			j++
+		}
+		ranges = append(ranges, [2]int{i, j})
+		i = j
+	}
+	return ranges
+}
+
+func (a *analysis) decompile(w io.Writer) {
+	for i, fn := range a.funcs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		a.decompileFunction(w, fn)
+	}
+	for _, r := range a.dataRanges() {
+		fmt.Fprintf(w, "\n// data [%d, %d): %v", r[0], r[1], a.prg[r[0]:r[1]])
+	}
+	fmt.Fprintln(w)
+}
+
+func decompile(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: intcode decompile <program>")
+	}
+	prg, err := loadProgram(args[0])
+	if err != nil {
+		return err
+	}
+	analyze(prg).decompile(os.Stdout)
+	return nil
+}
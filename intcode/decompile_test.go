@@ -0,0 +1,19 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var quine = []int{109, 1, 204, -1, 1001, 100, 1, 100, 1008, 100, 16, 101, 1006, 101, 0, 99}
+
+// The quine's loop moves the relative base each time round, so the cell it
+// outputs isn't a fixed frame slot.
+func TestDecompileMovingBase(t *testing.T) {
+	var sb strings.Builder
+	analyze(quine).decompile(&sb)
+	out := sb.String()
+	if !strings.Contains(out, "output(mem[rb-1])") || strings.Contains(out, "frame[") {
+		t.Errorf("decompiled quine:\n%s\nwant output(mem[rb-1]) and no frame cells", out)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dumps show memory like hexdump: each row starts with the address of its
+// first cell, followed by the cells and then the mnemonic of each cell that
+// starts a reachable instruction, or "." for other cells. Runs of rows of
+// zeroes are collapsed to "*", and the final line is the memory size.
+//
+//	     0:  1  9 10  3  2  3 11  0 | add . . . mul . . .
+//	     8: 99 30 40 50  0  0  0  0 | halt . . . . . . .
+//	*
+//	    24:  0  0  0  0  0  0  0  0 | . . . . . . . .
+//	    32:
+
+func writeDump(w io.Writer, mem []int, width int) {
+	code := analyze(mem).instrs
+	cellWidth := 1
+	for _, n := range mem {
+		if l := len(strconv.Itoa(n)); l > cellWidth {
+			cellWidth = l
+		}
+	}
+	skipping := false
+	for row := 0; row < len(mem); row += width {
+		end := row + width
+		if end > len(mem) {
+			end = len(mem)
+		}
+		cells := mem[row:end]
+		if row > 0 && end < len(mem) && allZero(cells) {
+			if !skipping {
+				fmt.Fprintln(w, "*")
+				skipping = true
+			}
+			continue
+		}
+		skipping = false
+
+		var values, names []string
+		for i, n := range cells {
+			values = append(values, fmt.Sprintf("%*d", cellWidth, n))
+			if in, ok := code[row+i]; ok {
+				names = append(names, signatures[in.code].name)
+			} else {
+				names = append(names, ".")
+			}
+		}
+		fmt.Fprintf(w, "%6d: %s | %s\n", row, strings.Join(values, " "), strings.Join(names, " "))
+	}
+	fmt.Fprintf(w, "%6d:\n", len(mem))
+}
+
+func allZero(ints []int) bool {
+	for _, n := range ints {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func parseDump(r io.Reader) ([]int, error) {
+	var mem []int
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || s == "*" {
+			continue
+		}
+		colon := strings.Index(s, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("line %d: missing address", line)
+		}
+		addr, err := strconv.Atoi(strings.TrimSpace(s[:colon]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if addr < len(mem) {
+			return nil, fmt.Errorf("line %d: address %d out of order", line, addr)
+		}
+		// Rows skipped with "*" are zeroes.
+		mem = append(mem, make([]int, addr-len(mem))...)
+		values := s[colon+1:]
+		if bar := strings.Index(values, "|"); bar >= 0 {
+			values = values[:bar]
+		}
+		for _, field := range strings.Fields(values) {
+			n, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			mem = append(mem, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mem, nil
+}
+
+// loadMemory reads a program, a snapshot from the server or a dump. The
+// snapshot is nil unless the file was a snapshot.
+func loadMemory(filename string) ([]int, *snapshot, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := strings.TrimSpace(string(b))
+	switch {
+	case strings.HasPrefix(s, "pc="):
+		snap, err := parseSnapshot(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		return snap.memory, snap, nil
+	case strings.Contains(s, ":"):
+		mem, err := parseDump(strings.NewReader(s))
+		return mem, nil, err
+	default:
+		mem, err := parseProgram([]byte(s))
+		return mem, nil, err
+	}
+}
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	width := fs.Int("width", 8, "cells per row")
+	in := fs.String("input", "", "run the program with this comma separated input before dumping")
+	maxSteps := fs.Int("steps", 0, "run the program for at most this many instructions before dumping")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *width < 1 {
+		return errors.New("usage: intcode dump [flags] <program|snapshot|dump>")
+	}
+
+	mem, _, err := loadMemory(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *in != "" || *maxSteps > 0 {
+		inputs, err := parseInputs(*in)
+		if err != nil {
+			return err
+		}
+		c := newComputer(mem, newIntBuffer(), newIntBuffer())
+		for _, n := range inputs {
+			c.input.WriteInt(n)
+		}
+		if err := c.runBudget(*maxSteps, time.Time{}); err != nil && err != errStepLimit {
+			return err
+		}
+		mem = c.memory.ints()
+	}
+	writeDump(os.Stdout, mem, *width)
+	return nil
+}
+
+const (
+	colorRed   = "\033[31m"
+	colorGreen = "\033[32m"
+	colorReset = "\033[0m"
+)
+
+// A change is a run of contiguous cells that differ between two memories.
+type change struct {
+	start int
+	old   []int
+	new   []int
+}
+
+func diffMemory(a, b []int) []*change {
+	size := len(a)
+	if len(b) > size {
+		size = len(b)
+	}
+	cell := func(mem []int, i int) int {
+		if i < len(mem) {
+			return mem[i]
+		}
+		return 0
+	}
+	var changes []*change
+	var cur *change
+	for i := 0; i < size; i++ {
+		x, y := cell(a, i), cell(b, i)
+		if x == y {
+			cur = nil
+			continue
+		}
+		if cur == nil {
+			cur = &change{start: i}
+			changes = append(changes, cur)
+		}
+		cur.old = append(cur.old, x)
+		cur.new = append(cur.new, y)
+	}
+	return changes
+}
+
+func writeDiff(w io.Writer, changes []*change, color bool) {
+	paint := func(c, s string) string {
+		if !color {
+			return s
+		}
+		return c + s + colorReset
+	}
+	join := func(ints []int) string {
+		s := make([]string, len(ints))
+		for i, n := range ints {
+			s[i] = strconv.Itoa(n)
+		}
+		return strings.Join(s, " ")
+	}
+	cells := 0
+	for _, c := range changes {
+		end := c.start + len(c.old) - 1
+		if end == c.start {
+			fmt.Fprintf(w, "@@ %d @@\n", c.start)
+		} else {
+			fmt.Fprintf(w, "@@ %d-%d @@\n", c.start, end)
+		}
+		fmt.Fprintln(w, paint(colorRed, "- "+join(c.old)))
+		fmt.Fprintln(w, paint(colorGreen, "+ "+join(c.new)))
+		cells += len(c.old)
+	}
+	fmt.Fprintf(w, "%d cells changed in %d groups\n", cells, len(changes))
+}
+
+func diff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	color := fs.Bool("color", false, "highlight changes with ANSI colors")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: intcode diff [flags] <old> <new>")
+	}
+
+	a, snapA, err := loadMemory(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, snapB, err := loadMemory(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if snapA != nil && snapB != nil {
+		if snapA.pc != snapB.pc {
+			fmt.Printf("pc %d -> %d\n", snapA.pc, snapB.pc)
+		}
+		if snapA.relBase != snapB.relBase {
+			fmt.Printf("rb %d -> %d\n", snapA.relBase, snapB.relBase)
+		}
+	}
+	writeDiff(os.Stdout, diffMemory(a, b), *color)
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode"
+)
+
+// Expressions are evaluated against a stopped computer in the debugger.
+// They're made of integers, the names pc, rb (or relBase), steps, in and
+// out (the last value input and output), mem[expr], parentheses and these
+// operators, from lowest to highest precedence:
+//
+//	||
+//	&&
+//	== != < <= > >=
+//	+ -
+//	* / %
+//	unary - !
+//
+// Comparisons and logical operators evaluate to 1 or 0, and any non-zero
+// value is true.
+
+type exprEnv struct {
+	c          *computer
+	lastInput  int
+	lastOutput int
+}
+
+type exprFunc func(env *exprEnv) int
+
+type expression struct {
+	src  string
+	eval exprFunc
+}
+
+// evaluate evaluates e, turning runtime errors like division by zero into
+// errors.
+func (e *expression) evaluate(env *exprEnv) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: %v", e.src, r)
+		}
+	}()
+	return e.eval(env), nil
+}
+
+func parseExpression(src string) (*expression, error) {
+	p := &exprParser{src: src}
+	p.advance()
+	eval, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("unexpected %q in %q", p.tok, src)
+	}
+	return &expression{src: src, eval: eval}, nil
+}
+
+type exprParser struct {
+	src string
+	pos int
+	tok string
+}
+
+var twoCharOps = []string{"||", "&&", "==", "!=", "<=", ">="}
+
+// advance moves to the next token, leaving "" at the end of the input.
+func (p *exprParser) advance() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+	start := p.pos
+	ch := rune(p.src[p.pos])
+	switch {
+	case unicode.IsDigit(ch):
+		for p.pos < len(p.src) && unicode.IsDigit(rune(p.src[p.pos])) {
+			p.pos++
+		}
+	case unicode.IsLetter(ch):
+		for p.pos < len(p.src) && (unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+	default:
+		p.pos++
+		for _, op := range twoCharOps {
+			if p.pos < len(p.src) && p.src[start:p.pos+1] == op {
+				p.pos++
+				break
+			}
+		}
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var binaryLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func binaryOp(op string, x, y exprFunc) exprFunc {
+	switch op {
+	case "||":
+		return func(env *exprEnv) int { return boolInt(x(env) != 0 || y(env) != 0) }
+	case "&&":
+		return func(env *exprEnv) int { return boolInt(x(env) != 0 && y(env) != 0) }
+	case "==":
+		return func(env *exprEnv) int { return boolInt(x(env) == y(env)) }
+	case "!=":
+		return func(env *exprEnv) int { return boolInt(x(env) != y(env)) }
+	case "<":
+		return func(env *exprEnv) int { return boolInt(x(env) < y(env)) }
+	case "<=":
+		return func(env *exprEnv) int { return boolInt(x(env) <= y(env)) }
+	case ">":
+		return func(env *exprEnv) int { return boolInt(x(env) > y(env)) }
+	case ">=":
+		return func(env *exprEnv) int { return boolInt(x(env) >= y(env)) }
+	case "+":
+		return func(env *exprEnv) int { return x(env) + y(env) }
+	case "-":
+		return func(env *exprEnv) int { return x(env) - y(env) }
+	case "*":
+		return func(env *exprEnv) int { return x(env) * y(env) }
+	case "/":
+		return func(env *exprEnv) int { return x(env) / y(env) }
+	case "%":
+		return func(env *exprEnv) int { return x(env) % y(env) }
+	}
+	panic("unknown operator " + op)
+}
+
+func (p *exprParser) parseBinary(level int) (exprFunc, error) {
+	if level == len(binaryLevels) {
+		return p.parseUnary()
+	}
+	x, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range binaryLevels[level] {
+			if p.tok == candidate {
+				op = candidate
+			}
+		}
+		if op == "" {
+			return x, nil
+		}
+		p.advance()
+		y, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = binaryOp(op, x, y)
+	}
+}
+
+func (p *exprParser) parseUnary() (exprFunc, error) {
+	switch p.tok {
+	case "-":
+		p.advance()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *exprEnv) int { return -x(env) }, nil
+	case "!":
+		p.advance()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *exprEnv) int { return boolInt(x(env) == 0) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) expect(tok string) error {
+	if p.tok != tok {
+		if p.tok == "" {
+			return fmt.Errorf("expected %q at end of %q", tok, p.src)
+		}
+		return fmt.Errorf("expected %q, got %q in %q", tok, p.tok, p.src)
+	}
+	p.advance()
+	return nil
+}
+
+func (p *exprParser) parsePrimary() (exprFunc, error) {
+	tok := p.tok
+	if tok == "" {
+		return nil, errors.New("unexpected end of expression")
+	}
+	p.advance()
+	if n, err := strconv.Atoi(tok); err == nil {
+		return func(*exprEnv) int { return n }, nil
+	}
+	switch tok {
+	case "pc":
+		return func(env *exprEnv) int { return env.c.pc }, nil
+	case "rb", "relBase":
+		return func(env *exprEnv) int { return env.c.relBase }, nil
+	case "steps":
+		return func(env *exprEnv) int { return env.c.steps }, nil
+	case "in":
+		return func(env *exprEnv) int { return env.lastInput }, nil
+	case "out":
+		return func(env *exprEnv) int { return env.lastOutput }, nil
+	case "mem":
+		if err := p.expect("["); err != nil {
+			return nil, err
+		}
+		addr, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return func(env *exprEnv) int { return env.c.memory.get(addr(env)) }, nil
+	case "(":
+		x, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+	return nil, fmt.Errorf("unexpected %q in %q", tok, p.src)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// hooks are callbacks a computer makes as it runs. Any of them may be nil.
+// They're called on the goroutine running the computer, so they should
+// return quickly and must not run the computer themselves.
+type hooks struct {
+	// beforeInstruction and afterInstruction are passed the address and
+	// value of the instruction.
+	beforeInstruction func(c *computer, pc, value int)
+	afterInstruction  func(c *computer, pc, value int)
+
+	memoryRead  func(c *computer, addr, n int)
+	memoryWrite func(c *computer, addr, old, new int)
+	// inputBlocked is called when the computer needs input and there's
+	// none to read, either before it blocks reading input or when
+	// runBudget stops because of it. inputConsumed follows once it gets
+	// some.
+	inputBlocked   func(c *computer)
+	inputConsumed  func(c *computer, n int)
+	outputProduced func(c *computer, n int)
+	relBaseChanged func(c *computer, old, new int)
+	// halted is called when the program halts by running opcode 99, and
+	// failed when the computer stops because an instruction failed.
+	halted func(c *computer)
+	failed func(c *computer, err error)
+}
+
+// observe registers h to be called for events on c.
+func (c *computer) observe(h *hooks) {
+	c.observers = append(c.observers, h)
+}
+
+// disassemble decodes the instruction at pc.
+func (c *computer) disassemble(pc int) (*instr, bool) {
+	cells := make([]int, 4)
+	for i := range cells {
+		cells[i] = c.memory.get(pc + i)
+	}
+	in, ok := decodeAt(cells, 0)
+	if ok {
+		in.addr = pc
+	}
+	return in, ok
+}
+
+// tracer returns hooks that log every event to w.
+func tracer(w io.Writer) *hooks {
+	return &hooks{
+		beforeInstruction: func(c *computer, pc, value int) {
+			in, ok := c.disassemble(pc)
+			if !ok {
+				fmt.Fprintf(w, "%6d  %d\n", pc, value)
+				return
+			}
+			fmt.Fprintf(w, "%6d  %s\n", pc, in)
+		},
+		memoryWrite: func(c *computer, addr, old, new int) {
+			fmt.Fprintf(w, "        mem[%d] %d -> %d\n", addr, old, new)
+		},
+		inputConsumed: func(c *computer, n int) {
+			fmt.Fprintf(w, "        input %d\n", n)
+		},
+		outputProduced: func(c *computer, n int) {
+			fmt.Fprintf(w, "        output %d\n", n)
+		},
+		relBaseChanged: func(c *computer, old, new int) {
+			fmt.Fprintf(w, "        rb %d -> %d\n", old, new)
+		},
+		halted: func(c *computer) {
+			fmt.Fprintf(w, "        halted after %d instructions\n", c.steps)
+		},
+		failed: func(c *computer, err error) {
+			fmt.Fprintf(w, "        failed after %d instructions: %v\n", c.steps, err)
+		},
+	}
+}
+
+func trace(args []string) error {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	in := fs.String("input", "", "comma separated program input")
+	maxSteps := fs.Int("steps", 0, "stop after this many instructions")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: intcode trace [flags] <program>")
+	}
+
+	prg, err := loadProgram(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	inputs, err := parseInputs(*in)
+	if err != nil {
+		return err
+	}
+	c := newComputer(prg, newIntBuffer(), newIntBuffer())
+	for _, n := range inputs {
+		c.input.WriteInt(n)
+	}
+	c.observe(tracer(os.Stdout))
+	if err := c.runBudget(*maxSteps, time.Time{}); err != nil {
+		return err
+	}
+	if c.running {
+		return errors.New("program is waiting for more input")
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailedHook(t *testing.T) {
+	c := newComputer([]int{104, 1, 98}, newIntBuffer(), newIntBuffer())
+	var halted bool
+	var failed error
+	c.observe(&hooks{
+		halted: func(c *computer) { halted = true },
+		failed: func(c *computer, err error) { failed = err },
+	})
+	err := c.runBudget(0, time.Time{})
+	if err == nil {
+		t.Fatal("running an unknown opcode didn't fail")
+	}
+	if failed != err {
+		t.Errorf("failed hook got %v, want %v", failed, err)
+	}
+	if halted {
+		t.Error("halted hook was called for a failed run")
+	}
+}
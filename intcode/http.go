@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxSteps  = 10_000_000
+	defaultTimeout   = 5 * time.Second
+	maxTimeout       = time.Minute
+	defaultMaxMemory = 1 << 20
+)
+
+type memoryPatch struct {
+	Addr  int `json:"addr"`
+	Value int `json:"value"`
+}
+
+type memoryRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type memorySlice struct {
+	Start  int   `json:"start"`
+	Values []int `json:"values"`
+}
+
+type runRequest struct {
+	Program   []int         `json:"program"`
+	Patches   []memoryPatch `json:"patches"`
+	Input     []int         `json:"input"`
+	Memory    []memoryRange `json:"memory"`
+	MaxSteps  int           `json:"max_steps"`
+	TimeoutMS int           `json:"timeout_ms"`
+	Lenient   bool          `json:"lenient"`
+}
+
+type runResponse struct {
+	Output []int         `json:"output"`
+	Memory []memorySlice `json:"memory,omitempty"`
+	Steps  int           `json:"steps"`
+	Halted bool          `json:"halted"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// validate checks a request that's to be run with at most maxMemory cells,
+// so that execute doesn't have to.
+func (req *runRequest) validate(maxMemory int) error {
+	if len(req.Program) == 0 {
+		return errors.New("program is empty")
+	}
+	if len(req.Program) > maxMemory {
+		return fmt.Errorf("program is longer than the %d cell memory limit", maxMemory)
+	}
+	for _, p := range req.Patches {
+		if p.Addr < 0 || p.Addr >= len(req.Program) {
+			return fmt.Errorf("patch address %d is outside the program", p.Addr)
+		}
+	}
+	for _, r := range req.Memory {
+		if r.Start < 0 || r.End < r.Start {
+			return fmt.Errorf("bad memory range [%d, %d)", r.Start, r.End)
+		}
+	}
+	if req.MaxSteps < 0 || req.TimeoutMS < 0 {
+		return errors.New("budgets must not be negative")
+	}
+	return nil
+}
+
+var runs int64
+
+// execute runs a request that has been validated, failing it if the
+// program writes past maxMemory cells.
+func execute(req *runRequest, maxMemory int) *runResponse {
+	maxSteps := req.MaxSteps
+	if maxSteps == 0 {
+		maxSteps = defaultMaxSteps
+	}
+	timeout := time.Duration(req.TimeoutMS) * time.Millisecond
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+
+	c := newComputer(req.Program, newIntBuffer(), newIntBuffer())
+	c.lenient = req.Lenient
+	c.memory.limit = maxMemory
+	// Runs are published while they execute, so a run that's using up its
+	// budget shows up in the metrics.
+	name := fmt.Sprintf("run-%d", atomic.AddInt64(&runs, 1))
+	newMachineMetrics(c).publish(name)
+	defer unpublishMetrics(name)
+	for _, p := range req.Patches {
+		c.memory.set(p.Addr, p.Value)
+	}
+	for _, n := range req.Input {
+		c.input.WriteInt(n)
+	}
+	err := c.runBudget(maxSteps, time.Now().Add(timeout))
+	if err == nil && c.running {
+		err = fmt.Errorf("program is waiting for input after consuming %d values", len(req.Input))
+	}
+
+	resp := &runResponse{
+		Output: c.output.Drain(),
+		Steps:  c.steps,
+		// Every other way of stopping is an error.
+		Halted: err == nil,
+	}
+	if resp.Output == nil {
+		resp.Output = []int{}
+	}
+	for _, r := range req.Memory {
+		slice := memorySlice{Start: r.Start, Values: []int{}}
+		for i := r.Start; i < r.End && i < c.memory.len(); i++ {
+			slice.Values = append(slice.Values, c.memory.get(i))
+		}
+		resp.Memory = append(resp.Memory, slice)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// handleRun returns a handler for run requests, which can each write at
+// most maxMemory cells.
+func handleRun(maxMemory int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST a run request", http.StatusMethodNotAllowed)
+			return
+		}
+		var req runRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(maxMemory); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(execute(&req, maxMemory)); err != nil {
+			log.Printf("%s: %s", r.RemoteAddr, err)
+		}
+	}
+}
+
+func serveHTTP(args []string) error {
+	fs := flag.NewFlagSet("http", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8019", "address to listen on")
+	maxMemory := fs.Int("max-memory", defaultMaxMemory, "memory cells each run can write")
+	fs.Parse(args)
+	if *maxMemory < 1 {
+		return errors.New("http: -max-memory must be at least 1")
+	}
+
+	if host, _, err := net.SplitHostPort(*addr); err == nil && !isLoopback(host) {
+		return errors.New("http: -addr must be a localhost address")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/run", handleRun(*maxMemory))
+	handleMetrics(mux)
+	log.Printf("serving intcode API on %s", *addr)
+	return http.ListenAndServe(*addr, mux)
+}
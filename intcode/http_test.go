@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunRejectsProgramPastMemoryLimit(t *testing.T) {
+	body := `{"program": [1101, 1, 1, 5, 99, 0], "patches": [{"addr": 5, "value": 7}]}`
+	w := httptest.NewRecorder()
+	handleRun(4)(w, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRunHalted(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		req     runRequest
+		halted  bool
+		wantErr bool
+	}{
+		{"halts", runRequest{Program: []int{104, 1, 99}}, true, false},
+		{"bad opcode", runRequest{Program: []int{104, 1, 98}}, false, true},
+		{"step limit", runRequest{Program: []int{1105, 1, 0}, MaxSteps: 10}, false, true},
+		{"waits for input", runRequest{Program: []int{3, 0, 99}}, false, true},
+	} {
+		resp := execute(&tt.req, defaultMaxMemory)
+		if resp.Halted != tt.halted || (resp.Error != "") != tt.wantErr {
+			t.Errorf("%s: halted %v with error %q, want halted %v", tt.name, resp.Halted, resp.Error, tt.halted)
+		}
+	}
+}
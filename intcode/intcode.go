@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+type mode int
+
+const (
+	modePosition  mode = 0
+	modeImmediate mode = 1
+	modeRelative  mode = 2
+)
+
+type computer struct {
+	pc      int
+	relBase int
+	memory  *memory
+	steps   int
+
+	// instrPC is the address of the instruction being executed.
+	instrPC int
+
+	input  *intBuffer
+	output *intBuffer
+
+	// lenient skips validating instruction modes when they're decoded, so
+	// extra mode digits are ignored and bad modes only fail when used.
+	lenient bool
+
+	observers []*hooks
+
+	running bool
+}
+
+func (c *computer) runProgram() {
+	for c.running {
+		c.step()
+	}
+}
+
+func (c *computer) step() {
+	c.instrPC = c.pc
+	value := c.next()
+	for _, h := range c.observers {
+		if h.beforeInstruction != nil {
+			h.beforeInstruction(c, c.instrPC, value)
+		}
+	}
+	code, modes, err := decode(value, c.lenient)
+	if err != nil {
+		panic(err)
+	}
+	opcodes[code](c, modes)
+	c.steps++
+	for _, h := range c.observers {
+		if h.afterInstruction != nil {
+			h.afterInstruction(c, c.instrPC, value)
+		}
+		if !c.running && h.halted != nil {
+			h.halted(c)
+		}
+	}
+}
+
+// waitingForInput reports whether the next instruction is an input that
+// would block because nothing has been written to the input buffer yet.
+// It returns the error step would panic with if the instruction can't be
+// decoded.
+func (c *computer) waitingForInput() (bool, error) {
+	if !c.running {
+		return false, nil
+	}
+	code, _, err := decode(c.memory.get(c.pc), c.lenient)
+	return code == 3 && c.input.Len() == 0, err
+}
+
+// outputFull reports whether the next instruction is an output that would
+// block because the output buffer is full. Like waitingForInput, it fails if
+// the instruction can't be decoded.
+func (c *computer) outputFull() (bool, error) {
+	if !c.running {
+		return false, nil
+	}
+	code, _, err := decode(c.memory.get(c.pc), c.lenient)
+	return code == 4 && c.output.Full(), err
+}
+
+// blocked reports whether the next instruction would wait for input or for
+// room in the output.
+func (c *computer) blocked() (bool, error) {
+	if waiting, err := c.waitingForInput(); waiting || err != nil {
+		return waiting, err
+	}
+	return c.outputFull()
+}
+
+var (
+	errStepLimit = errors.New("step limit exceeded")
+	errTimeout   = errors.New("time limit exceeded")
+)
+
+// runUntilBlocked runs the program until it halts, waits for input or
+// waits for room in its output.
+// Panics raised while executing the program halt the computer and are
+// returned as errors.
+func (c *computer) runUntilBlocked() error {
+	return c.runBudget(0, time.Time{})
+}
+
+// runBudget is like runUntilBlocked, but gives up once the computer has
+// executed maxSteps instructions or the deadline has passed. Zero values
+// mean no limit.
+func (c *computer) runBudget(maxSteps int, deadline time.Time) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = c.fail(fmt.Errorf("pc %d: %v", c.instrPC, r))
+		}
+	}()
+	for c.running {
+		blocked, err := c.blocked()
+		if err != nil {
+			return c.fail(fmt.Errorf("pc %d: %v", c.pc, err))
+		}
+		if blocked {
+			break
+		}
+		if maxSteps > 0 && c.steps >= maxSteps {
+			return errStepLimit
+		}
+		// Checking the clock is slow relative to an instruction.
+		if !deadline.IsZero() && c.steps%1024 == 0 && time.Now().After(deadline) {
+			return errTimeout
+		}
+		c.step()
+	}
+	// The loop has already decoded the next instruction, so this can't fail.
+	if waiting, _ := c.waitingForInput(); waiting {
+		c.inputBlocked()
+	}
+	return nil
+}
+
+// fail stops the computer because of err, which it returns.
+func (c *computer) fail(err error) error {
+	c.running = false
+	for _, h := range c.observers {
+		if h.failed != nil {
+			h.failed(c, err)
+		}
+	}
+	return err
+}
+
+func (c *computer) inputBlocked() {
+	for _, h := range c.observers {
+		if h.inputBlocked != nil {
+			h.inputBlocked(c)
+		}
+	}
+}
+
+func parseOpcodeModes(value int) (code int, modes []mode) {
+	code = value % 100
+	value /= 100
+	for value > 0 {
+		modes = append(modes, mode(value%10))
+		value /= 10
+	}
+	return code, modes
+}
+
+// decode splits an instruction into its opcode and parameter modes. Unless
+// lenient is set, the modes are checked against the opcode's parameters.
+func decode(value int, lenient bool) (code int, modes []mode, err error) {
+	code, modes = parseOpcodeModes(value)
+	sig, ok := signatures[code]
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown opcode %d", code)
+	}
+	if lenient {
+		return code, modes, nil
+	}
+	if len(modes) > sig.params {
+		return 0, nil, fmt.Errorf("instruction %d has %d modes but %s takes %d parameters", value, len(modes), sig.name, sig.params)
+	}
+	for i, m := range modes {
+		switch m {
+		case modePosition, modeRelative:
+		case modeImmediate:
+			if i == sig.write {
+				return 0, nil, fmt.Errorf("instruction %d writes to an immediate parameter", value)
+			}
+		default:
+			return 0, nil, fmt.Errorf("instruction %d has unknown mode %d", value, m)
+		}
+	}
+	return code, modes, nil
+}
+
+func fillModes(modes []mode, size int) []mode {
+	if len(modes) < size {
+		filled := make([]mode, size)
+		copy(filled, modes)
+		modes = filled
+	}
+	return modes
+}
+
+func newComputer(prg []int, input, output *intBuffer) *computer {
+	return &computer{
+		memory:  newMemory(prg),
+		input:   input,
+		output:  output,
+		running: true,
+	}
+}
+
+func (c *computer) next() int {
+	n := c.memory.get(c.pc)
+	c.pc++
+	return n
+}
+
+// fork returns a copy of the computer, connected to the given buffers, that
+// shares memory with c until either of them writes to it. Like
+// memory.fork, it has to be called on the goroutine running c, if any.
+func (c *computer) fork(input, output *intBuffer) *computer {
+	f := *c
+	f.memory = c.memory.fork()
+	f.input = input
+	f.output = output
+	f.observers = append([]*hooks{}, c.observers...)
+	return &f
+}
+
+func (c *computer) read(m mode) int {
+	idx := c.next()
+	switch m {
+	case modeImmediate:
+		return idx
+	case modePosition:
+	case modeRelative:
+		idx += c.relBase
+	default:
+		panic(fmt.Sprintf("unknown mode %d", m))
+	}
+	n := c.memory.get(idx)
+	for _, h := range c.observers {
+		if h.memoryRead != nil {
+			h.memoryRead(c, idx, n)
+		}
+	}
+	return n
+}
+
+func (c *computer) write(n int, m mode) {
+	idx := c.next()
+	switch m {
+	case modeImmediate:
+		panic("immediate mode used for write")
+	case modePosition:
+	case modeRelative:
+		idx += c.relBase
+	}
+	if len(c.observers) == 0 {
+		c.memory.set(idx, n)
+		return
+	}
+	old := c.memory.get(idx)
+	c.memory.set(idx, n)
+	for _, h := range c.observers {
+		if h.memoryWrite != nil {
+			h.memoryWrite(c, idx, old, n)
+		}
+	}
+}
+
+func add(c *computer, modes []mode) {
+	modes = fillModes(modes, 3)
+	a := c.read(modes[0])
+	b := c.read(modes[1])
+	c.write(a+b, modes[2])
+}
+
+func mul(c *computer, modes []mode) {
+	modes = fillModes(modes, 3)
+	a := c.read(modes[0])
+	b := c.read(modes[1])
+	c.write(a*b, modes[2])
+}
+
+func input(c *computer, modes []mode) {
+	modes = fillModes(modes, 1)
+	if len(c.observers) > 0 && c.input.Len() == 0 {
+		c.inputBlocked()
+	}
+	n, err := c.input.ReadInt()
+	if err != nil {
+		panic(fmt.Sprintf("reading input: %v", err))
+	}
+	for _, h := range c.observers {
+		if h.inputConsumed != nil {
+			h.inputConsumed(c, n)
+		}
+	}
+	c.write(n, modes[0])
+}
+
+func output(c *computer, modes []mode) {
+	modes = fillModes(modes, 1)
+	n := c.read(modes[0])
+	c.output.WriteInt(n)
+	for _, h := range c.observers {
+		if h.outputProduced != nil {
+			h.outputProduced(c, n)
+		}
+	}
+}
+
+func jit(c *computer, modes []mode) {
+	modes = fillModes(modes, 2)
+	n := c.read(modes[0])
+	v := c.read(modes[1])
+	if n != 0 {
+		c.pc = v
+	}
+}
+
+func jif(c *computer, modes []mode) {
+	modes = fillModes(modes, 2)
+	n := c.read(modes[0])
+	v := c.read(modes[1])
+	if n == 0 {
+		c.pc = v
+	}
+}
+
+func lt(c *computer, modes []mode) {
+	modes = fillModes(modes, 3)
+	a := c.read(modes[0])
+	b := c.read(modes[1])
+	if a < b {
+		c.write(1, modes[2])
+	} else {
+		c.write(0, modes[2])
+	}
+}
+
+func eq(c *computer, modes []mode) {
+	modes = fillModes(modes, 3)
+	a := c.read(modes[0])
+	b := c.read(modes[1])
+	if a == b {
+		c.write(1, modes[2])
+	} else {
+		c.write(0, modes[2])
+	}
+}
+
+func rel(c *computer, modes []mode) {
+	modes = fillModes(modes, 1)
+	old := c.relBase
+	c.relBase += c.read(modes[0])
+	for _, h := range c.observers {
+		if h.relBaseChanged != nil {
+			h.relBaseChanged(c, old, c.relBase)
+		}
+	}
+}
+
+func halt(c *computer, _ []mode) {
+	c.running = false
+}
+
+type opcode func(c *computer, modes []mode)
+
+var opcodes map[int]opcode = map[int]opcode{
+	1:  add,
+	2:  mul,
+	3:  input,
+	4:  output,
+	5:  jit,
+	6:  jif,
+	7:  lt,
+	8:  eq,
+	9:  rel,
+	99: halt,
+}
+
+type signature struct {
+	name   string
+	params int
+	// write is the index of the parameter the instruction writes to, or -1.
+	write int
+}
+
+var signatures = map[int]signature{
+	1:  {"add", 3, 2},
+	2:  {"mul", 3, 2},
+	3:  {"in", 1, 0},
+	4:  {"out", 1, -1},
+	5:  {"jit", 2, -1},
+	6:  {"jif", 2, -1},
+	7:  {"lt", 3, 2},
+	8:  {"eq", 3, 2},
+	9:  {"rel", 1, -1},
+	99: {"halt", 0, -1},
+}
+
+type snapshot struct {
+	pc      int
+	relBase int
+	running bool
+	memory  []int
+}
+
+func (c *computer) snapshot() *snapshot {
+	return &snapshot{
+		pc:      c.pc,
+		relBase: c.relBase,
+		running: c.running,
+		memory:  c.memory.ints(),
+	}
+}
+
+func (s *snapshot) String() string {
+	mem := make([]string, len(s.memory))
+	for i, n := range s.memory {
+		mem[i] = strconv.Itoa(n)
+	}
+	return fmt.Sprintf("pc=%d rb=%d running=%t mem=%s", s.pc, s.relBase, s.running, strings.Join(mem, ","))
+}
+
+func parseSnapshot(s string) (*snapshot, error) {
+	snap := new(snapshot)
+	for _, field := range strings.Fields(s) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed snapshot field %q", field)
+		}
+		var err error
+		switch kv[0] {
+		case "pc":
+			snap.pc, err = strconv.Atoi(kv[1])
+		case "rb":
+			snap.relBase, err = strconv.Atoi(kv[1])
+		case "running":
+			snap.running, err = strconv.ParseBool(kv[1])
+		case "mem":
+			snap.memory, err = parseProgram([]byte(kv[1]))
+		default:
+			err = fmt.Errorf("unknown snapshot field %q", kv[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snap, nil
+}
+
+var errBufferClosed = errors.New("buffer is closed")
+
+// An intBuffer is a queue of ints between a computer and whatever feeds it
+// or reads its output. If it has a capacity, writers wait while it's full;
+// a capacity of zero means it's unbounded. Once it's closed, reads return
+// what's left and then io.EOF.
+type intBuffer struct {
+	wait     *sync.Cond
+	ints     []int
+	capacity int
+	closed   bool
+}
+
+func newIntBuffer() *intBuffer {
+	return newBoundedIntBuffer(0)
+}
+
+func newBoundedIntBuffer(capacity int) *intBuffer {
+	var mu sync.Mutex
+	return &intBuffer{
+		wait:     sync.NewCond(&mu),
+		capacity: capacity,
+	}
+}
+
+// ReadInt removes and returns the next value, waiting until there is one.
+func (rw *intBuffer) ReadInt() (int, error) {
+	return rw.ReadIntContext(context.Background())
+}
+
+// ReadIntContext is like ReadInt, but gives up with the context's error
+// once it's done.
+func (rw *intBuffer) ReadIntContext(ctx context.Context) (int, error) {
+	if ctx.Done() != nil {
+		// Waiting on the condition can't also wait on the context, so wake
+		// every waiter when it's done.
+		stop := context.AfterFunc(ctx, func() {
+			rw.wait.L.Lock()
+			rw.wait.Broadcast()
+			rw.wait.L.Unlock()
+		})
+		defer stop()
+	}
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	for len(rw.ints) == 0 && !rw.closed {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		rw.wait.Wait()
+	}
+	if len(rw.ints) == 0 {
+		return 0, io.EOF
+	}
+	n := rw.ints[0]
+	rw.ints = rw.ints[1:]
+	rw.wait.Broadcast()
+	return n, nil
+}
+
+// WriteInt adds a value, waiting while the buffer is full. It panics if
+// the buffer is closed, like sending on a closed channel.
+func (rw *intBuffer) WriteInt(n int) {
+	rw.wait.L.Lock()
+	for rw.isFull() && !rw.closed {
+		rw.wait.Wait()
+	}
+	if rw.closed {
+		rw.wait.L.Unlock()
+		panic(errBufferClosed)
+	}
+	rw.ints = append(rw.ints, n)
+	rw.wait.Broadcast()
+	rw.wait.L.Unlock()
+}
+
+func (rw *intBuffer) isFull() bool {
+	return rw.capacity > 0 && len(rw.ints) >= rw.capacity
+}
+
+// Full reports whether a write would wait.
+func (rw *intBuffer) Full() bool {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	return rw.isFull() && !rw.closed
+}
+
+// Len returns the number of values waiting to be read.
+func (rw *intBuffer) Len() int {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	return len(rw.ints)
+}
+
+// Drain removes and returns everything currently in the buffer.
+func (rw *intBuffer) Drain() []int {
+	rw.wait.L.Lock()
+	defer rw.wait.L.Unlock()
+	ints := rw.ints
+	rw.ints = nil
+	rw.wait.Broadcast()
+	return ints
+}
+
+// Close marks the end of the values. Readers get io.EOF once they've read
+// everything already written, and waiting writers panic.
+func (rw *intBuffer) Close() {
+	rw.wait.L.Lock()
+	if rw.closed {
+		rw.wait.L.Unlock()
+		return
+	}
+	rw.closed = true
+	rw.wait.Broadcast()
+	rw.wait.L.Unlock()
+}
+
+func parseProgram(b []byte) ([]int, error) {
+	var prg []int
+	for _, s := range bytes.Split(b, []byte(",")) {
+		n, err := strconv.Atoi(strings.TrimSpace(string(s)))
+		if err != nil {
+			return nil, err
+		}
+		prg = append(prg, n)
+	}
+	return prg, nil
+}
+
+// parseInputs parses a comma or whitespace separated list of integers.
+func parseInputs(s string) ([]int, error) {
+	var ints []int
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+func loadProgram(filename string) ([]int, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseProgram(b)
+}
+
+var commands = map[string]func(args []string) error{
+	"conformance": runConformance,
+	"debug":       debug,
+	"compile":     compile,
+	"decompile":   decompile,
+	"diff":        diff,
+	"dump":        dump,
+	"http":        serveHTTP,
+	"optimize":    optimize,
+	"serve":       serve,
+	"trace":       trace,
+	"worker":      runWorker,
+	"workers":     workers,
+}
+
+func usage() error {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return errors.New("usage: intcode <" + strings.Join(names, "|") + "> [flags]")
+}
+
+func run() error {
+	if len(os.Args) < 2 {
+		return usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		return usage()
+	}
+	return cmd(os.Args[2:])
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
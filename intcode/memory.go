@@ -0,0 +1,101 @@
+package main
+
+import "fmt"
+
+const (
+	pageShift = 6
+	pageSize  = 1 << pageShift
+	pageMask  = pageSize - 1
+)
+
+// memory is split into pages so that a forked computer can share pages
+// with its parent, copying a page only when one of them writes to it.
+type memory struct {
+	pages [][]int
+	// owned reports whether each page belongs to this memory alone and can
+	// be written in place. A nil page reads as zeroes.
+	owned []bool
+	size  int
+	// limit, if positive, is how many cells can be written. Writing past
+	// it panics, so a program can't use up the process's memory.
+	limit int
+}
+
+func newMemory(prg []int) *memory {
+	m := new(memory)
+	for addr, n := range prg {
+		m.set(addr, n)
+	}
+	return m
+}
+
+func (m *memory) len() int {
+	return m.size
+}
+
+func (m *memory) get(addr int) int {
+	if addr < 0 {
+		panic(fmt.Sprintf("negative address %d", addr))
+	}
+	p := addr >> pageShift
+	if p >= len(m.pages) || m.pages[p] == nil {
+		return 0
+	}
+	return m.pages[p][addr&pageMask]
+}
+
+func (m *memory) set(addr, n int) {
+	if addr < 0 {
+		panic(fmt.Sprintf("negative address %d", addr))
+	}
+	if m.limit > 0 && addr >= m.limit {
+		panic(fmt.Sprintf("address %d is past the memory limit of %d cells", addr, m.limit))
+	}
+	p := addr >> pageShift
+	if p >= len(m.pages) {
+		pages := make([][]int, p+1)
+		copy(pages, m.pages)
+		m.pages = pages
+		owned := make([]bool, p+1)
+		copy(owned, m.owned)
+		m.owned = owned
+	}
+	if !m.owned[p] {
+		page := make([]int, pageSize)
+		copy(page, m.pages[p])
+		m.pages[p] = page
+		m.owned[p] = true
+	}
+	m.pages[p][addr&pageMask] = n
+	if addr >= m.size {
+		m.size = addr + 1
+	}
+}
+
+// fork returns a memory that shares every page with m. Both m and the fork
+// copy a page the first time they write to it afterwards, so a fork is only
+// cheaper than copying the whole memory when it writes to a few pages; see
+// BenchmarkForkPages.
+//
+// Forking clears m's owned flags, so it changes m: it isn't safe while
+// another goroutine is using m, such as a computer that's still running.
+func (m *memory) fork() *memory {
+	for i := range m.owned {
+		m.owned[i] = false
+	}
+	return &memory{
+		pages: append([][]int{}, m.pages...),
+		owned: make([]bool, len(m.owned)),
+		size:  m.size,
+		limit: m.limit,
+	}
+}
+
+// ints returns a copy of the memory as a slice.
+func (m *memory) ints() []int {
+	ints := make([]int, m.size)
+	for i := range ints {
+		ints[i] = m.get(i)
+	}
+	return ints
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+const benchMemorySize = 4096
+
+// benchForks compares forking a computer by copying its memory, which is
+// how the per-day computers are cloned, against forking with shared pages.
+// Each fork writes a few cells spread across memory, like a program updating
+// some variables would.
+func benchForks(b *testing.B, fork func(f, writes, stride int)) {
+	for _, writes := range []int{1, 8, 64} {
+		stride := benchMemorySize / writes
+		b.Run(fmt.Sprintf("writes=%d", writes), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				fork(i, writes, stride)
+			}
+		})
+	}
+}
+
+func BenchmarkForkClone(b *testing.B) {
+	prg := make([]int, benchMemorySize)
+	benchForks(b, func(f, writes, stride int) {
+		mem := append([]int{}, prg...)
+		for w := 0; w < writes; w++ {
+			mem[w*stride] = f
+		}
+	})
+}
+
+func BenchmarkForkPages(b *testing.B) {
+	parent := newMemory(make([]int, benchMemorySize))
+	benchForks(b, func(f, writes, stride int) {
+		mem := parent.fork()
+		for w := 0; w < writes; w++ {
+			mem.set(w*stride, f)
+		}
+	})
+}
+
+// fixedForks is how many forks BenchmarkFixedForks makes per operation.
+const fixedForks = 10_000
+
+// BenchmarkFixedForks makes fixedForks forks that each write to 8 cells,
+// to compare the total cost of a fixed-size search rather than per fork.
+func BenchmarkFixedForks(b *testing.B) {
+	const writes = 8
+	stride := benchMemorySize / writes
+	b.Run("clone", func(b *testing.B) {
+		prg := make([]int, benchMemorySize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for f := 0; f < fixedForks; f++ {
+				mem := append([]int{}, prg...)
+				for w := 0; w < writes; w++ {
+					mem[w*stride] = f
+				}
+			}
+		}
+	})
+	b.Run("pages", func(b *testing.B) {
+		parent := newMemory(make([]int, benchMemorySize))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for f := 0; f < fixedForks; f++ {
+				mem := parent.fork()
+				for w := 0; w < writes; w++ {
+					mem.set(w*stride, f)
+				}
+			}
+		}
+	})
+}
+
+func TestForkSharesUntilWrite(t *testing.T) {
+	parent := newMemory([]int{1, 2, 3})
+	child := parent.fork()
+	child.set(1, 20)
+	parent.set(2, 30)
+	if got := parent.ints(); fmt.Sprint(got) != "[1 2 30]" {
+		t.Errorf("parent = %v, want [1 2 30]", got)
+	}
+	if got := child.ints(); fmt.Sprint(got) != "[1 20 3]" {
+		t.Errorf("child = %v, want [1 20 3]", got)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	m := newMemory([]int{99})
+	m.limit = 10
+	m.set(9, 1)
+	defer func() {
+		if recover() == nil {
+			t.Error("writing past the limit didn't panic")
+		}
+	}()
+	m.set(10, 1)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// machineVars holds the metrics of every published machine, keyed by name.
+// They're served as JSON on /debug/vars and as Prometheus text on /metrics.
+var machineVars = expvar.NewMap("intcode_machines")
+
+// machineMetrics counts what a computer has done. The counters are updated
+// by hooks on the computer's goroutine and can be read from any other.
+type machineMetrics struct {
+	instructions atomic.Int64
+	inputs       atomic.Int64
+	outputs      atomic.Int64
+	memorySize   atomic.Int64
+	// blocked is the total time spent waiting for input, not counting the
+	// current wait, which started at blockedSince (in Unix nanoseconds) or
+	// is zero if the computer isn't waiting.
+	blocked      atomic.Int64
+	blockedSince atomic.Int64
+}
+
+type metricsValues struct {
+	Instructions int64   `json:"instructions"`
+	Inputs       int64   `json:"inputs"`
+	Outputs      int64   `json:"outputs"`
+	MemorySize   int64   `json:"memory_size"`
+	Blocked      float64 `json:"blocked_seconds"`
+	Waiting      bool    `json:"waiting"`
+}
+
+// newMachineMetrics starts counting for c. Publish the metrics to make them
+// visible.
+func newMachineMetrics(c *computer) *machineMetrics {
+	m := new(machineMetrics)
+	m.memorySize.Store(int64(c.memory.len()))
+	c.observe(&hooks{
+		afterInstruction: func(c *computer, pc, value int) {
+			m.instructions.Add(1)
+		},
+		memoryWrite: func(c *computer, addr, old, new int) {
+			if size := int64(c.memory.len()); size != m.memorySize.Load() {
+				m.memorySize.Store(size)
+			}
+		},
+		inputBlocked: func(c *computer) {
+			m.blockedSince.CompareAndSwap(0, time.Now().UnixNano())
+		},
+		inputConsumed: func(c *computer, n int) {
+			m.inputs.Add(1)
+			if since := m.blockedSince.Swap(0); since != 0 {
+				m.blocked.Add(time.Now().UnixNano() - since)
+			}
+		},
+		outputProduced: func(c *computer, n int) {
+			m.outputs.Add(1)
+		},
+	})
+	return m
+}
+
+func (m *machineMetrics) values() metricsValues {
+	blocked := m.blocked.Load()
+	since := m.blockedSince.Load()
+	if since != 0 {
+		blocked += time.Now().UnixNano() - since
+	}
+	return metricsValues{
+		Instructions: m.instructions.Load(),
+		Inputs:       m.inputs.Load(),
+		Outputs:      m.outputs.Load(),
+		MemorySize:   m.memorySize.Load(),
+		Blocked:      time.Duration(blocked).Seconds(),
+		Waiting:      since != 0,
+	}
+}
+
+// String implements expvar.Var.
+func (m *machineMetrics) String() string {
+	b, err := json.Marshal(m.values())
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+func (m *machineMetrics) publish(name string) {
+	machineVars.Set(name, m)
+}
+
+func unpublishMetrics(name string) {
+	machineVars.Delete(name)
+}
+
+// writePrometheus writes the metrics of every published machine in the
+// Prometheus text format.
+func writePrometheus(w http.ResponseWriter) {
+	values := make(map[string]metricsValues)
+	var names []string
+	machineVars.Do(func(kv expvar.KeyValue) {
+		if m, ok := kv.Value.(*machineMetrics); ok {
+			values[kv.Key] = m.values()
+			names = append(names, kv.Key)
+		}
+	})
+	sort.Strings(names)
+
+	metrics := []struct {
+		name, kind, help string
+		value            func(v metricsValues) interface{}
+	}{
+		{"intcode_instructions_total", "counter", "Instructions executed.", func(v metricsValues) interface{} { return v.Instructions }},
+		{"intcode_inputs_total", "counter", "Input values consumed.", func(v metricsValues) interface{} { return v.Inputs }},
+		{"intcode_outputs_total", "counter", "Output values produced.", func(v metricsValues) interface{} { return v.Outputs }},
+		{"intcode_memory_cells", "gauge", "Memory size in cells.", func(v metricsValues) interface{} { return v.MemorySize }},
+		{"intcode_blocked_seconds_total", "counter", "Time spent waiting for input.", func(v metricsValues) interface{} { return v.Blocked }},
+		{"intcode_waiting", "gauge", "Whether the machine is waiting for input.", func(v metricsValues) interface{} { return boolInt(v.Waiting) }},
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", metric.name, metric.kind)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{machine=%q} %v\n", metric.name, name, metric.value(values[name]))
+		}
+	}
+}
+
+// handleMetrics registers the metrics endpoints on mux.
+func handleMetrics(mux *http.ServeMux) {
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writePrometheus(w)
+	})
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The optimizer rewrites a program so that it executes fewer instructions.
+// It works on the instructions the decompiler's analysis can reach:
+//
+//   - Reads of cells whose value is known within a basic block become
+//     immediates.
+//   - Arithmetic and comparisons on immediates become a constant store, and
+//     jumps on immediates become an unconditional jump or nothing.
+//   - Stores of a cell to itself are dropped.
+//   - Jumps to unconditional jumps go straight to the final target, and
+//     unconditional jumps to the next instruction are dropped.
+//   - In programs that don't use relative mode, which could read any cell,
+//     stores to cells no instruction reads are dropped.
+//
+// Dropping an instruction moves the code after it, which is only done when
+// the program doesn't read or write its code as data and every indirect
+// jump is a relative-mode return from the decompiler's call idiom, whose
+// return addresses can be moved too. Otherwise instructions are only
+// rewritten in place. Instructions the program reads or writes as data are
+// never changed, and when relative mode might reach the code, which is
+// unless the relative base provably stays after it, none are.
+//
+// Any other jump through a cell could land in the middle of a block, so
+// then nothing known is carried from one instruction to the next.
+//
+// Equivalent means producing the same output from the same input. Dropped
+// stores change the final memory, so cells whose final value matters, like
+// cell 0 in day 2, have to be kept with -keep.
+
+type optimizer struct {
+	prg    []int
+	a      *analysis
+	instrs map[int]*instr
+	order  []*instr
+	// leaders are the addresses that start basic blocks.
+	leaders map[int]bool
+	// frozen instructions are read or written as data.
+	frozen  map[int]bool
+	removed map[int]bool
+	keep    map[int]bool
+
+	relocatable bool
+	// relative reports whether any instruction uses relative mode.
+	relative bool
+
+	stats map[string]int
+}
+
+func newOptimizer(prg []int, keep []int) *optimizer {
+	o := &optimizer{
+		prg:     prg,
+		a:       analyze(prg),
+		instrs:  make(map[int]*instr),
+		leaders: map[int]bool{0: true},
+		frozen:  make(map[int]bool),
+		removed: make(map[int]bool),
+		keep:    make(map[int]bool),
+		stats:   make(map[string]int),
+	}
+	for _, addr := range keep {
+		o.keep[addr] = true
+	}
+	for addr, in := range o.a.instrs {
+		c := *in
+		c.args = append([]operand{}, in.args...)
+		o.instrs[addr] = &c
+		o.order = append(o.order, &c)
+	}
+	sort.Slice(o.order, func(i, j int) bool { return o.order[i].addr < o.order[j].addr })
+
+	code := make(map[int]int)
+	for _, in := range o.order {
+		for addr := in.addr; addr < in.end(); addr++ {
+			code[addr] = in.addr
+		}
+	}
+	o.relocatable = true
+	// indirect is set by a jump whose target isn't known, other than a
+	// return, so it could land in the middle of any block.
+	indirect := false
+	for i, in := range o.order {
+		if i > 0 && in.addr < o.order[i-1].end() {
+			// Overlapping instructions can't be moved independently.
+			o.relocatable = false
+		}
+		for _, op := range in.args {
+			switch op.mode {
+			case modePosition:
+				if at, ok := code[op.value]; ok {
+					o.frozen[at] = true
+					o.relocatable = false
+				}
+			case modeRelative:
+				o.relative = true
+			}
+		}
+		if !in.isJump() {
+			continue
+		}
+		o.leaders[in.end()] = true
+		if t, ok := in.target(); ok {
+			o.leaders[t] = true
+			if _, ok := o.instrs[t]; !ok {
+				o.relocatable = false
+			}
+		} else if in.args[1].mode != modeRelative || len(o.a.pushes) == 0 {
+			indirect = true
+			o.relocatable = false
+		}
+	}
+	for addr := range o.a.pushes {
+		ret := o.returnAddr(o.instrs[addr])
+		o.leaders[ret] = true
+		if _, ok := o.instrs[ret]; !ok {
+			o.relocatable = false
+		}
+	}
+	if indirect {
+		for _, in := range o.order {
+			o.leaders[in.addr] = true
+		}
+	}
+	if o.relative && !o.baseOutsideCode() {
+		// A relative-mode operand could read or write any instruction.
+		for _, in := range o.order {
+			o.frozen[in.addr] = true
+		}
+		o.relocatable = false
+	}
+	return o
+}
+
+// baseOutsideCode reports whether every relative-mode operand provably
+// addresses a cell after the code. The base starts at zero, and the
+// analysis knows how far it has moved within each function since entry, so
+// the lowest base a function can be entered with follows from its callers'.
+func (o *optimizer) baseOutsideCode() bool {
+	codeEnd := 0
+	for _, in := range o.order {
+		if in.end() > codeEnd {
+			codeEnd = in.end()
+		}
+	}
+
+	entryBase := map[int]int{0: 0}
+	for changed, round := true, 0; changed; round++ {
+		if round > len(o.a.funcs) {
+			// A recursive call keeps lowering the base.
+			return false
+		}
+		changed = false
+		for _, fn := range o.a.funcs {
+			base, ok := entryBase[fn.entry]
+			if !ok {
+				continue
+			}
+			for addr := range fn.instrs {
+				callee, isCall := o.a.calls[addr]
+				if !isCall {
+					continue
+				}
+				delta, ok := fn.rbDelta[addr]
+				if !ok {
+					return false
+				}
+				if b, seen := entryBase[callee]; !seen || base+delta < b {
+					entryBase[callee] = base + delta
+					changed = true
+				}
+			}
+		}
+	}
+
+	checked := make(map[int]bool)
+	for _, fn := range o.a.funcs {
+		base, entered := entryBase[fn.entry]
+		for addr, in := range fn.instrs {
+			for _, op := range in.args {
+				if op.mode != modeRelative {
+					continue
+				}
+				delta, ok := fn.rbDelta[addr]
+				if !entered || !ok || base+delta+op.value < codeEnd {
+					return false
+				}
+			}
+			checked[addr] = true
+		}
+	}
+	for _, in := range o.order {
+		for _, op := range in.args {
+			if op.mode == modeRelative && !checked[in.addr] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// returnAddr returns the address a call's push instruction stores.
+func (o *optimizer) returnAddr(in *instr) int {
+	if in.code == 1 {
+		return in.args[0].value + in.args[1].value
+	}
+	return in.args[0].value * in.args[1].value
+}
+
+// resolve skips over dropped instructions starting at addr.
+func (o *optimizer) resolve(addr int) int {
+	for o.removed[addr] {
+		addr = o.instrs[addr].end()
+	}
+	return addr
+}
+
+func (o *optimizer) remove(in *instr, why string) {
+	if o.relocatable && !o.removed[in.addr] {
+		o.removed[in.addr] = true
+		o.stats[why]++
+	}
+}
+
+func isUnconditional(in *instr) bool {
+	if !in.isJump() {
+		return false
+	}
+	always, _ := in.taken()
+	return always
+}
+
+func (o *optimizer) optimize() {
+	for pass := 0; pass < 10; pass++ {
+		before := fmt.Sprint(o.stats)
+		o.propagate()
+		o.thread()
+		o.dropDeadStores()
+		if fmt.Sprint(o.stats) == before {
+			return
+		}
+	}
+}
+
+// A cellKey identifies a cell either by its address or, for relative mode,
+// by its offset from the relative base at the start of the block.
+type cellKey struct {
+	relative bool
+	addr     int
+}
+
+type blockState struct {
+	known   map[cellKey]int
+	shift   int
+	rbKnown bool
+}
+
+func (s *blockState) reset() {
+	s.known = make(map[cellKey]int)
+	s.shift = 0
+	s.rbKnown = true
+}
+
+func (s *blockState) key(op operand) (cellKey, bool) {
+	switch op.mode {
+	case modePosition:
+		return cellKey{false, op.value}, true
+	case modeRelative:
+		return cellKey{true, op.value + s.shift}, s.rbKnown
+	}
+	return cellKey{}, false
+}
+
+func (s *blockState) forget(relative bool) {
+	for k := range s.known {
+		if k.relative == relative {
+			delete(s.known, k)
+		}
+	}
+}
+
+// store records a write to dst, which may alias any cell addressed with the
+// other mode.
+func (s *blockState) store(dst operand, value int, known bool) {
+	s.forget(dst.mode != modeRelative)
+	k, ok := s.key(dst)
+	if !ok {
+		return
+	}
+	if known {
+		s.known[k] = value
+	} else {
+		delete(s.known, k)
+	}
+}
+
+func sameCell(x, y operand) bool {
+	return x.mode != modeImmediate && x == y
+}
+
+func evalConstant(code, x, y int) int {
+	switch code {
+	case 1:
+		return x + y
+	case 2:
+		return x * y
+	case 7:
+		return boolInt(x < y)
+	}
+	return boolInt(x == y)
+}
+
+// propagate replaces reads of known cells with immediates and folds
+// instructions on immediates, one basic block at a time.
+func (o *optimizer) propagate() {
+	var s blockState
+	for i, in := range o.order {
+		if i == 0 || o.leaders[in.addr] || in.addr != o.order[i-1].end() {
+			s.reset()
+		}
+		if o.removed[in.addr] {
+			continue
+		}
+		if o.frozen[in.addr] {
+			// The program may have rewritten it, so nothing is known after it.
+			s.reset()
+			continue
+		}
+		sig := signatures[in.code]
+		for j, op := range in.args {
+			if j == sig.write || (in.isJump() && j == 1) {
+				continue
+			}
+			if k, ok := s.key(op); ok {
+				if v, ok := s.known[k]; ok {
+					in.args[j] = operand{modeImmediate, v}
+					o.stats["propagated"]++
+				}
+			}
+		}
+
+		switch in.code {
+		case 1, 2, 7, 8:
+			x, y, dst := in.args[0], in.args[1], in.args[2]
+			if x.mode == modeImmediate && y.mode == modeImmediate {
+				v := evalConstant(in.code, x.value, y.value)
+				if in.code != 1 || x.value != v || y.value != 0 {
+					in.code = 1
+					in.args[0], in.args[1] = operand{modeImmediate, v}, operand{modeImmediate, 0}
+					o.stats["folded"]++
+				}
+				s.store(dst, v, true)
+				continue
+			}
+			identity := 0
+			if in.code == 2 {
+				identity = 1
+			}
+			if in.code <= 2 && (sameCell(x, dst) && y == operand{modeImmediate, identity} ||
+				sameCell(y, dst) && x == operand{modeImmediate, identity}) {
+				o.remove(in, "self stores")
+				continue
+			}
+			s.store(dst, 0, false)
+		case 3:
+			s.store(in.args[0], 0, false)
+		case 5, 6:
+			always, never := in.taken()
+			switch {
+			case always && (in.code != 5 || in.args[0].value != 1):
+				in.code = 5
+				in.args[0] = operand{modeImmediate, 1}
+				o.stats["folded"]++
+			case never:
+				o.remove(in, "folded")
+			}
+		case 9:
+			if in.args[0].mode == modeImmediate {
+				s.shift += in.args[0].value
+			} else {
+				s.rbKnown = false
+				s.forget(true)
+			}
+		}
+	}
+}
+
+// thread retargets jumps to unconditional jumps and drops unconditional
+// jumps to the next instruction.
+func (o *optimizer) thread() {
+	for _, in := range o.order {
+		if !in.isJump() || o.removed[in.addr] || o.frozen[in.addr] {
+			continue
+		}
+		t, ok := in.target()
+		if !ok {
+			continue
+		}
+		final := t
+		for hops := 0; hops < len(o.order); hops++ {
+			next, ok := o.instrs[o.resolve(final)]
+			if !ok || o.frozen[next.addr] || !isUnconditional(next) {
+				break
+			}
+			nt, ok := next.target()
+			if !ok || nt == final {
+				break
+			}
+			final = nt
+		}
+		if final != t {
+			in.args[1].value = final
+			o.stats["threaded"]++
+		}
+		_, isCall := o.a.calls[in.addr]
+		if isUnconditional(in) && !isCall && o.resolve(final) == o.resolve(in.end()) {
+			o.remove(in, "threaded")
+		}
+	}
+}
+
+func (o *optimizer) dropDeadStores() {
+	if o.relative {
+		return
+	}
+	read := make(map[int]bool)
+	for _, in := range o.order {
+		if o.removed[in.addr] {
+			continue
+		}
+		sig := signatures[in.code]
+		for j, op := range in.args {
+			if op.mode == modePosition && (j != sig.write || o.frozen[in.addr]) {
+				read[op.value] = true
+			}
+		}
+	}
+	for _, in := range o.order {
+		switch in.code {
+		case 1, 2, 7, 8:
+		default:
+			continue
+		}
+		dst := in.args[2]
+		if dst.mode == modePosition && !read[dst.value] && !o.keep[dst.value] && !o.frozen[in.addr] {
+			o.remove(in, "dead stores")
+		}
+	}
+}
+
+func (in *instr) encode() []int {
+	value, scale := in.code, 100
+	for _, op := range in.args {
+		value += int(op.mode) * scale
+		scale *= 10
+	}
+	cells := []int{value}
+	for _, op := range in.args {
+		cells = append(cells, op.value)
+	}
+	return cells
+}
+
+// program lays out the optimized instructions. Moved code keeps to the
+// cells it was in, padded with zeroes, so data addresses don't change.
+func (o *optimizer) program() []int {
+	prg := append([]int{}, o.prg...)
+	if !o.relocatable {
+		for _, in := range o.order {
+			copy(prg[in.addr:], in.encode())
+		}
+		return prg
+	}
+
+	moved := make(map[int]int)
+	cursor := 0
+	for i, in := range o.order {
+		if i == 0 || in.addr != o.order[i-1].end() {
+			if i > 0 {
+				for ; cursor < o.order[i-1].end(); cursor++ {
+					prg[cursor] = 0
+				}
+			}
+			cursor = in.addr
+		}
+		moved[in.addr] = cursor
+		if !o.removed[in.addr] {
+			cursor = in.end() - in.addr + cursor
+		}
+	}
+	if len(o.order) > 0 {
+		for ; cursor < o.order[len(o.order)-1].end(); cursor++ {
+			prg[cursor] = 0
+		}
+	}
+
+	for _, in := range o.order {
+		if o.removed[in.addr] {
+			continue
+		}
+		out := *in
+		out.args = append([]operand{}, in.args...)
+		if in.isJump() {
+			if t, ok := in.target(); ok {
+				out.args[1].value = moved[t]
+			}
+		}
+		if o.a.pushes[in.addr] {
+			out.code = 1
+			out.args[0] = operand{modeImmediate, moved[o.returnAddr(in)]}
+			out.args[1] = operand{modeImmediate, 0}
+		}
+		copy(prg[moved[in.addr]:], out.encode())
+	}
+	return prg
+}
+
+// runOnce runs prg on input and returns its output, its final memory and
+// the number of instructions it executed.
+func runOnce(prg, input []int, maxSteps int) ([]int, *memory, int, error) {
+	c := newComputer(prg, newIntBuffer(), newIntBuffer())
+	for _, n := range input {
+		c.input.WriteInt(n)
+	}
+	err := c.runBudget(maxSteps, time.Time{})
+	if err == nil && c.running {
+		err = errors.New("waiting for input")
+	}
+	return c.output.Drain(), c.memory, c.steps, err
+}
+
+// inputSets collects each -input flag.
+type inputSets []string
+
+func (f *inputSets) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *inputSets) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+func optimize(args []string) error {
+	fs := flag.NewFlagSet("optimize", flag.ExitOnError)
+	var sets inputSets
+	fs.Var(&sets, "input", "comma separated input to check the optimized program with (repeatable)")
+	keepFlag := fs.String("keep", "", "comma separated cells whose final value must be kept")
+	maxSteps := fs.Int("steps", defaultMaxSteps, "instruction limit for each check")
+	out := fs.String("o", "", "write the program to this file instead of stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: intcode optimize [flags] <program>")
+	}
+	if len(sets) == 0 {
+		sets = inputSets{""}
+	}
+
+	prg, err := loadProgram(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	keep, err := parseInputs(*keepFlag)
+	if err != nil {
+		return err
+	}
+	for _, addr := range keep {
+		if addr < 0 {
+			return fmt.Errorf("optimize: -keep cell %d is negative", addr)
+		}
+	}
+	o := newOptimizer(prg, keep)
+	o.optimize()
+	opt := o.program()
+
+	var names []string
+	for name := range o.stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "%s: %d\n", name, o.stats[name])
+	}
+	if !o.relocatable {
+		fmt.Fprintln(os.Stderr, "code can't be moved, so it was only rewritten in place")
+	}
+
+	for _, set := range sets {
+		input, err := parseInputs(set)
+		if err != nil {
+			return err
+		}
+		want, wantMem, before, err := runOnce(prg, input, *maxSteps)
+		if err != nil {
+			return fmt.Errorf("input [%s]: original program: %v", set, err)
+		}
+		got, gotMem, after, err := runOnce(opt, input, *maxSteps)
+		if err != nil {
+			return fmt.Errorf("input [%s]: optimized program: %v", set, err)
+		}
+		if !equalInts(got, want) {
+			return fmt.Errorf("input [%s]: optimized program output %v, want %v", set, got, want)
+		}
+		for _, addr := range keep {
+			if g, w := gotMem.get(addr), wantMem.get(addr); g != w {
+				return fmt.Errorf("input [%s]: optimized program left %d in cell %d, want %d", set, g, addr, w)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "input [%s]: %d -> %d steps (%.2fx)\n", set, before, after, float64(before)/float64(after))
+	}
+
+	ints := make([]string, len(opt))
+	for i, n := range opt {
+		ints[i] = strconv.Itoa(n)
+	}
+	csv := strings.Join(ints, ",") + "\n"
+	if *out == "" {
+		_, err = os.Stdout.WriteString(csv)
+		return err
+	}
+	return ioutil.WriteFile(*out, []byte(csv), 0644)
+}
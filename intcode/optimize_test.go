@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+// checkOptimized optimizes prg and checks it still outputs what the
+// original does.
+func checkOptimized(t *testing.T, prg, input []int) {
+	t.Helper()
+	o := newOptimizer(prg, nil)
+	o.optimize()
+	want, _, _, err := runOnce(prg, input, conformanceMaxSteps)
+	if err != nil {
+		t.Fatalf("original program: %v", err)
+	}
+	got, _, _, err := runOnce(o.program(), input, conformanceMaxSteps)
+	if err != nil {
+		t.Fatalf("optimized program: %v", err)
+	}
+	if !equalInts(got, want) {
+		t.Errorf("optimized program output %v, want %v", got, want)
+	}
+}
+
+// An indirect jump lands in the middle of the block that stored 7 in cell
+// 50, after cell 50 has changed.
+func TestOptimizeIndirectJump(t *testing.T) {
+	checkOptimized(t, []int{
+		1101, 0, 7, 50, 1101, 0, 8, 51, 4, 50, 1005, 52, 24,
+		1101, 0, 1, 52, 1101, 0, 9, 50, 106, 0, 51, 99,
+	}, nil)
+}
+
+// With the relative base at zero, the output reads the add's first operand.
+func TestOptimizeRelativeCodeRead(t *testing.T) {
+	checkOptimized(t, []int{109, 0, 1101, 2, 3, 40, 204, 3, 99}, nil)
+}
+
+func TestOptimizeCompiled(t *testing.T) {
+	src := `
+func fib(n) {
+	if (n < 2) {
+		return n;
+	}
+	return fib(n - 1) + fib(n - 2);
+}
+
+func main() {
+	var n = input();
+	while (n > 0) {
+		output(fib(n));
+		n = n - 1;
+	}
+}`
+	prg, err := compileSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := newOptimizer(prg, nil); !o.relocatable {
+		t.Error("compiled code's stack should be provably after the code")
+	}
+	checkOptimized(t, prg, []int{10})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The server speaks a line protocol. Each request is a command followed by
+// space-separated arguments, and each response is a single line starting
+// with "ok" or "err":
+//
+//	new <program>        ok <id> <state>
+//	in <id> <n>...       ok <state>
+//	out <id>             ok <n>...
+//	snapshot <id>        ok pc=<pc> rb=<rb> running=<bool> mem=<memory>
+//	halt <id>            ok
+//
+// A machine runs until it halts or blocks whenever it's created or given
+// input, so its state is "waiting" for input, "full" if its output buffer
+// is full, or "halted". A full machine resumes after its output is read
+// with out and it's given input, which may be no values at all.
+//
+// Machines belong to the connection that created them: other connections
+// can't see them, and they're dropped when the connection closes.
+
+type session struct {
+	mu sync.Mutex
+	c  *computer
+}
+
+func (s *session) state() (string, error) {
+	if !s.c.running {
+		return "halted", nil
+	}
+	full, err := s.c.outputFull()
+	if err != nil {
+		return "", err
+	}
+	if full {
+		return "full", nil
+	}
+	return "waiting", nil
+}
+
+type server struct {
+	lenient bool
+	// maxOutput bounds each machine's output buffer when it's positive.
+	maxOutput int
+	// maxMemory is how many cells each machine can write.
+	maxMemory int
+	// metrics publishes each machine's metrics as "machine-<id>".
+	metrics bool
+
+	// IDs are unique across connections so metrics names don't clash.
+	mu     sync.Mutex
+	nextID int
+}
+
+func newServer() *server {
+	return &server{
+		nextID:    1,
+		maxMemory: defaultMaxMemory,
+	}
+}
+
+// A client holds the machines created on one connection.
+type client struct {
+	s        *server
+	sessions map[int]*session
+}
+
+func (s *server) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	cl := &client{s: s, sessions: make(map[int]*session)}
+	defer cl.close()
+	scanner := bufio.NewScanner(conn)
+	// Programs are sent on a single line and can be long.
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	w := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		resp, err := cl.handle(line)
+		if err != nil {
+			fmt.Fprintf(w, "err %s\n", err)
+		} else if resp == "" {
+			fmt.Fprintln(w, "ok")
+		} else {
+			fmt.Fprintf(w, "ok %s\n", resp)
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("%s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+func (cl *client) handle(line string) (string, error) {
+	fields := strings.Fields(line)
+	cmd, args := fields[0], fields[1:]
+	if cmd == "new" {
+		return cl.create(strings.Join(args, ""))
+	}
+	if len(args) < 1 {
+		return "", fmt.Errorf("%s: missing machine id", cmd)
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "", fmt.Errorf("%s: bad machine id %q", cmd, args[0])
+	}
+	sess, ok := cl.sessions[id]
+	if !ok {
+		return "", fmt.Errorf("no machine with id %d", id)
+	}
+	args = args[1:]
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	switch cmd {
+	case "in":
+		if !sess.c.running {
+			return "", fmt.Errorf("machine %d has halted", id)
+		}
+		for _, arg := range args {
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return "", fmt.Errorf("in: bad value %q", arg)
+			}
+			sess.c.input.WriteInt(n)
+		}
+		if err := sess.c.runUntilBlocked(); err != nil {
+			return "", err
+		}
+		return sess.state()
+	case "out":
+		ints := sess.c.output.Drain()
+		outs := make([]string, len(ints))
+		for i, n := range ints {
+			outs[i] = strconv.Itoa(n)
+		}
+		return strings.Join(outs, " "), nil
+	case "snapshot":
+		return sess.c.snapshot().String(), nil
+	case "halt":
+		sess.c.running = false
+		delete(cl.sessions, id)
+		unpublishMetrics(fmt.Sprintf("machine-%d", id))
+		return "", nil
+	default:
+		return "", fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func (cl *client) create(program string) (string, error) {
+	s := cl.s
+	prg, err := parseProgram([]byte(program))
+	if err != nil {
+		return "", fmt.Errorf("new: %s", err)
+	}
+	if len(prg) > s.maxMemory {
+		return "", fmt.Errorf("new: program is longer than the memory limit of %d cells", s.maxMemory)
+	}
+	sess := &session{c: newComputer(prg, newIntBuffer(), newBoundedIntBuffer(s.maxOutput))}
+	sess.c.lenient = s.lenient
+	sess.c.memory.limit = s.maxMemory
+	var metrics *machineMetrics
+	if s.metrics {
+		metrics = newMachineMetrics(sess.c)
+	}
+	if err := sess.c.runUntilBlocked(); err != nil {
+		return "", err
+	}
+	state, err := sess.state()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID++
+	s.mu.Unlock()
+	cl.sessions[id] = sess
+	if metrics != nil {
+		metrics.publish(fmt.Sprintf("machine-%d", id))
+	}
+	return fmt.Sprintf("%d %s", id, state), nil
+}
+
+// close drops the client's machines when its connection closes.
+func (cl *client) close() {
+	for id := range cl.sessions {
+		unpublishMetrics(fmt.Sprintf("machine-%d", id))
+	}
+	cl.sessions = nil
+}
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:7019", "TCP address to listen on")
+	socket := fs.String("socket", "", "Unix socket to listen on instead of -addr")
+	lenient := fs.Bool("lenient", false, "don't validate instruction modes when decoding")
+	maxOutput := fs.Int("max-output", 0, "values each machine can output before it has to be read, or 0 for no limit")
+	metricsAddr := fs.String("metrics", "", "localhost address to serve machine metrics on")
+	maxMemory := fs.Int("max-memory", defaultMaxMemory, "memory cells each machine can write")
+	fs.Parse(args)
+	if *maxMemory < 1 {
+		return errors.New("serve: -max-memory must be at least 1")
+	}
+
+	var l net.Listener
+	var err error
+	if *socket != "" {
+		l, err = net.Listen("unix", *socket)
+	} else {
+		if host, _, err := net.SplitHostPort(*addr); err == nil && !isLoopback(host) {
+			return errors.New("serve: -addr must be a localhost address")
+		}
+		l, err = net.Listen("tcp", *addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Printf("serving intcode machines on %s", l.Addr())
+	s := newServer()
+	s.lenient = *lenient
+	s.maxOutput = *maxOutput
+	s.maxMemory = *maxMemory
+	if *metricsAddr != "" {
+		if host, _, err := net.SplitHostPort(*metricsAddr); err == nil && !isLoopback(host) {
+			return errors.New("serve: -metrics must be a localhost address")
+		}
+		mux := http.NewServeMux()
+		handleMetrics(mux)
+		ml, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			return err
+		}
+		defer ml.Close()
+		log.Printf("serving metrics on http://%s/metrics", ml.Addr())
+		go http.Serve(ml, mux)
+		s.metrics = true
+	}
+	return s.serve(l)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
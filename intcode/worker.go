@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A machine runs a program that reads its input from one intBuffer and
+// writes its output to another, either in this process or in a worker.
+type machine interface {
+	// run runs the program until it halts or fails, waiting whenever it
+	// needs input or room for its output.
+	run() error
+	// snapshot returns the machine's state at a point where it was blocked
+	// or halted, so never in the middle of an instruction.
+	snapshot() (*snapshot, error)
+}
+
+// A localMachine runs a computer on the calling goroutine.
+type localMachine struct {
+	c *computer
+
+	mu sync.Mutex
+	// blocked shares memory with c as it was the last time it blocked.
+	blocked *computer
+}
+
+func newLocalMachine(prg []int, input, output *intBuffer) *localMachine {
+	c := newComputer(prg, input, output)
+	return &localMachine{c: c, blocked: c.fork(nil, nil)}
+}
+
+func (m *localMachine) run() error {
+	for {
+		err := m.c.runUntilBlocked()
+		m.mu.Lock()
+		m.blocked = m.c.fork(nil, nil)
+		m.mu.Unlock()
+		if err != nil || !m.c.running {
+			return err
+		}
+		if err := m.c.wait(); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *localMachine) snapshot() (*snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.blocked.snapshot(), nil
+}
+
+// wait executes the instruction the computer is blocked on, waiting for
+// input or for room for its output. Like runBudget, it returns panics as
+// errors.
+func (c *computer) wait() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = c.fail(fmt.Errorf("pc %d: %v", c.instrPC, r))
+		}
+	}()
+	c.step()
+	return nil
+}
+
+// restore returns a computer in the state captured by snap.
+func restore(snap *snapshot, input, output *intBuffer) *computer {
+	c := newComputer(snap.memory, input, output)
+	c.pc = snap.pc
+	c.relBase = snap.relBase
+	c.running = snap.running
+	return c
+}
+
+// A supervisor and a worker exchange frames over the worker's stdin and
+// stdout. A frame is a type byte, the length of the payload as a uvarint,
+// and the payload, which is a list of varints unless it's an error message.
+//
+//	start     supervisor  lenient, then the snapshot to run: pc, rb, running, memory...
+//	input     supervisor  input values
+//	close     supervisor  no more input will be sent
+//	snapshot  both        a request for a snapshot, and the reply
+//	output    worker      output values
+//	halt      worker      the program halted; its final snapshot
+//	error     worker      the program failed; the message
+//
+// A worker only reads frames when its program is waiting for input, so a
+// snapshot request is answered the next time it blocks.
+type frameType byte
+
+const (
+	frameStart frameType = iota + 1
+	frameInput
+	frameClose
+	frameSnapshot
+	frameOutput
+	frameHalt
+	frameError
+)
+
+// maxFrame bounds payloads so a corrupt length can't exhaust memory.
+const maxFrame = 1 << 30
+
+// workerOutputBatch is how many outputs a worker collects before sending
+// them without waiting for the program to block.
+const workerOutputBatch = 256
+
+var errWorkerStopped = errors.New("worker has stopped")
+
+func writeFrame(w *bufio.Writer, t frameType, payload []byte) error {
+	var size [binary.MaxVarintLen64]byte
+	w.WriteByte(byte(t))
+	w.Write(size[:binary.PutUvarint(size[:], uint64(len(payload)))])
+	w.Write(payload)
+	return w.Flush()
+}
+
+func readFrame(r *bufio.Reader) (frameType, []byte, error) {
+	t, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	size, err := binary.ReadUvarint(r)
+	if err == nil && size > maxFrame {
+		err = fmt.Errorf("frame of %d bytes is too big", size)
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return frameType(t), payload, nil
+}
+
+func encodeInts(ints []int) []byte {
+	var b []byte
+	for _, n := range ints {
+		b = binary.AppendVarint(b, int64(n))
+	}
+	return b
+}
+
+func decodeInts(b []byte) ([]int, error) {
+	var ints []int
+	for len(b) > 0 {
+		n, size := binary.Varint(b)
+		if size <= 0 {
+			return nil, errors.New("malformed varint in frame")
+		}
+		ints = append(ints, int(n))
+		b = b[size:]
+	}
+	return ints, nil
+}
+
+func (s *snapshot) ints() []int {
+	return append([]int{s.pc, s.relBase, boolInt(s.running)}, s.memory...)
+}
+
+func decodeSnapshot(b []byte) (*snapshot, error) {
+	ints, err := decodeInts(b)
+	if err != nil {
+		return nil, err
+	}
+	return snapshotFromInts(ints)
+}
+
+func snapshotFromInts(ints []int) (*snapshot, error) {
+	if len(ints) < 3 {
+		return nil, errors.New("short snapshot frame")
+	}
+	return &snapshot{
+		pc:      ints[0],
+		relBase: ints[1],
+		running: ints[2] != 0,
+		memory:  ints[3:],
+	}, nil
+}
+
+// runWorker is the worker command. It's started by a supervisor, which
+// speaks the frame protocol on its stdin and stdout, and isn't meant to be
+// run by hand.
+func runWorker(args []string) error {
+	r := bufio.NewReader(os.Stdin)
+	w := bufio.NewWriter(os.Stdout)
+	t, payload, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if t != frameStart {
+		return fmt.Errorf("worker: expected a start frame, got type %d", t)
+	}
+	ints, err := decodeInts(payload)
+	if err != nil {
+		return err
+	}
+	if len(ints) == 0 {
+		return errors.New("worker: empty start frame")
+	}
+	snap, err := snapshotFromInts(ints[1:])
+	if err != nil {
+		return err
+	}
+	c := restore(snap, newIntBuffer(), newBoundedIntBuffer(workerOutputBatch))
+	c.lenient = ints[0] != 0
+	closed := false
+	for {
+		runErr := c.runUntilBlocked()
+		waiting := false
+		if runErr == nil {
+			waiting, runErr = c.waitingForInput()
+		}
+		if runErr == nil && closed && waiting {
+			// Let the input instruction fail the way it would in process.
+			c.input.Close()
+			runErr = c.wait()
+		}
+		if out := c.output.Drain(); len(out) > 0 {
+			if err := writeFrame(w, frameOutput, encodeInts(out)); err != nil {
+				return err
+			}
+		}
+		switch {
+		case runErr != nil:
+			return writeFrame(w, frameError, []byte(runErr.Error()))
+		case !c.running:
+			return writeFrame(w, frameHalt, encodeInts(c.snapshot().ints()))
+		case !waiting:
+			// The output filled up and has been sent.
+			continue
+		}
+
+		t, payload, err := readFrame(r)
+		if err == io.EOF {
+			// The supervisor has gone away.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t {
+		case frameInput:
+			ints, err := decodeInts(payload)
+			if err != nil {
+				return err
+			}
+			for _, n := range ints {
+				c.input.WriteInt(n)
+			}
+		case frameClose:
+			closed = true
+		case frameSnapshot:
+			if err := writeFrame(w, frameSnapshot, encodeInts(c.snapshot().ints())); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("worker: unexpected frame type %d", t)
+		}
+	}
+}
+
+// A supervisor runs machines in worker processes, which are this binary
+// started with the worker command.
+type supervisor struct {
+	exe string
+	// maxRestarts is how many times a worker's process is restarted after
+	// crashing before the worker gives up.
+	maxRestarts int
+	// lenient is passed on to every worker's computer.
+	lenient bool
+}
+
+const defaultMaxRestarts = 3
+
+func newSupervisor() (*supervisor, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return &supervisor{exe: exe, maxRestarts: defaultMaxRestarts}, nil
+}
+
+type workerProcess struct {
+	cmd   *exec.Cmd
+	stdin io.Closer
+	in    *bufio.Writer
+	out   *bufio.Reader
+}
+
+func (s *supervisor) start() (*workerProcess, error) {
+	cmd := exec.Command(s.exe, "worker")
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &workerProcess{
+		cmd:   cmd,
+		stdin: stdin,
+		in:    bufio.NewWriter(stdin),
+		out:   bufio.NewReader(stdout),
+	}, nil
+}
+
+// send writes a frame to the process. Errors are ignored: they mean the
+// process has died, which the reader finds out about.
+func (p *workerProcess) send(t frameType, payload []byte) {
+	writeFrame(p.in, t, payload)
+}
+
+func (p *workerProcess) stop() {
+	p.stdin.Close()
+	p.cmd.Wait()
+}
+
+func (p *workerProcess) kill() {
+	p.cmd.Process.Kill()
+	p.stop()
+}
+
+// A worker is a machine that runs in a worker process. If the process
+// crashes, it's restarted with the program and every input sent so far.
+// Programs are deterministic, so it repeats the outputs already delivered,
+// which are dropped.
+type worker struct {
+	sup    *supervisor
+	prg    []int
+	input  *intBuffer
+	output *intBuffer
+
+	mu       sync.Mutex
+	proc     *workerProcess
+	inputs   []int
+	closed   bool
+	pending  []chan *snapshot
+	final    *snapshot
+	done     bool
+	restarts int
+
+	// delivered counts the values written to output, and skip how many
+	// outputs of the current process to drop because they already were.
+	delivered int
+	skip      int
+}
+
+func (s *supervisor) newWorker(prg []int, input, output *intBuffer) *worker {
+	return &worker{sup: s, prg: prg, input: input, output: output}
+}
+
+// launch starts a process and brings it up to date. w.mu must be held.
+func (w *worker) launch() error {
+	p, err := w.sup.start()
+	if err != nil {
+		return err
+	}
+	start := &snapshot{running: true, memory: w.prg}
+	p.send(frameStart, encodeInts(append([]int{boolInt(w.sup.lenient)}, start.ints()...)))
+	if len(w.inputs) > 0 {
+		p.send(frameInput, encodeInts(w.inputs))
+	}
+	if w.closed {
+		p.send(frameClose, nil)
+	}
+	for range w.pending {
+		p.send(frameSnapshot, nil)
+	}
+	w.proc = p
+	w.skip = w.delivered
+	return nil
+}
+
+func (w *worker) run() error {
+	w.mu.Lock()
+	err := w.launch()
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.sendInput(ctx)
+
+	for {
+		final, err := w.receive(w.proc)
+		if err == nil {
+			w.finish(final)
+			w.proc.stop()
+			return nil
+		}
+		if _, ok := err.(programError); ok {
+			w.finish(nil)
+			w.proc.stop()
+			return err
+		}
+		w.proc.kill()
+		w.mu.Lock()
+		if w.restarts >= w.sup.maxRestarts {
+			w.mu.Unlock()
+			w.finish(nil)
+			return fmt.Errorf("worker crashed %d times, last with: %v", w.restarts+1, err)
+		}
+		w.restarts++
+		log.Printf("worker crashed (%v); restarting it", err)
+		err = w.launch()
+		w.mu.Unlock()
+		if err != nil {
+			w.finish(nil)
+			return err
+		}
+	}
+}
+
+// A programError is an error reported by the program rather than caused
+// by its process crashing, so restarting wouldn't help.
+type programError string
+
+func (e programError) Error() string { return string(e) }
+
+// receive handles frames from p until the program halts, when it returns
+// the final snapshot.
+func (w *worker) receive(p *workerProcess) (*snapshot, error) {
+	for {
+		t, payload, err := readFrame(p.out)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case frameOutput:
+			ints, err := decodeInts(payload)
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range ints {
+				if w.skip > 0 {
+					w.skip--
+					continue
+				}
+				w.output.WriteInt(n)
+				w.delivered++
+			}
+		case frameSnapshot:
+			snap, err := decodeSnapshot(payload)
+			if err != nil {
+				return nil, err
+			}
+			w.mu.Lock()
+			if len(w.pending) > 0 {
+				w.pending[0] <- snap
+				w.pending = w.pending[1:]
+			}
+			w.mu.Unlock()
+		case frameHalt:
+			return decodeSnapshot(payload)
+		case frameError:
+			return nil, programError(payload)
+		default:
+			return nil, fmt.Errorf("unexpected frame type %d from worker", t)
+		}
+	}
+}
+
+// sendInput passes values from the input buffer to the current process,
+// remembering them in case it has to be restarted.
+func (w *worker) sendInput(ctx context.Context) {
+	for {
+		n, err := w.input.ReadIntContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		w.mu.Lock()
+		if w.done {
+			w.mu.Unlock()
+			return
+		}
+		if err != nil {
+			w.closed = true
+			w.proc.send(frameClose, nil)
+			w.mu.Unlock()
+			return
+		}
+		ints := append([]int{n}, w.input.Drain()...)
+		w.inputs = append(w.inputs, ints...)
+		w.proc.send(frameInput, encodeInts(ints))
+		w.mu.Unlock()
+	}
+}
+
+// finish answers snapshot requests with the final snapshot, or fails them
+// if there isn't one.
+func (w *worker) finish(final *snapshot) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.done = true
+	w.final = final
+	for _, ch := range w.pending {
+		if final != nil {
+			ch <- final
+		}
+		close(ch)
+	}
+	w.pending = nil
+}
+
+func (w *worker) snapshot() (*snapshot, error) {
+	w.mu.Lock()
+	if w.done {
+		defer w.mu.Unlock()
+		if w.final == nil {
+			return nil, errWorkerStopped
+		}
+		return w.final, nil
+	}
+	if w.proc == nil {
+		w.mu.Unlock()
+		return nil, errors.New("worker hasn't started")
+	}
+	ch := make(chan *snapshot, 1)
+	w.pending = append(w.pending, ch)
+	w.proc.send(frameSnapshot, nil)
+	w.mu.Unlock()
+	snap, ok := <-ch
+	if !ok {
+		return nil, errWorkerStopped
+	}
+	return snap, nil
+}
+
+// workers runs a program once for each input set, each in its own worker
+// process, and prints the outputs in order.
+func workers(args []string) error {
+	fs := flag.NewFlagSet("workers", flag.ExitOnError)
+	var sets inputSets
+	fs.Var(&sets, "input", "comma separated input for one run of the program (repeatable)")
+	procs := fs.Int("procs", runtime.NumCPU(), "runs to do at once")
+	restarts := fs.Int("restarts", defaultMaxRestarts, "times to restart a crashed worker")
+	local := fs.Bool("local", false, "run each machine in this process instead")
+	lenient := fs.Bool("lenient", false, "don't validate instruction modes when decoding")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: intcode workers [flags] <program>")
+	}
+	if len(sets) == 0 {
+		sets = inputSets{""}
+	}
+	if *procs < 1 {
+		return errors.New("workers: -procs must be at least 1")
+	}
+
+	prg, err := loadProgram(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	inputs := make([][]int, len(sets))
+	for i, s := range sets {
+		if inputs[i], err = parseInputs(s); err != nil {
+			return err
+		}
+	}
+	sup, err := newSupervisor()
+	if err != nil {
+		return err
+	}
+	sup.maxRestarts = *restarts
+	sup.lenient = *lenient
+
+	outputs := make([][]int, len(sets))
+	errs := make([]error, len(sets))
+	sem := make(chan struct{}, *procs)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range sets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			in, out := newIntBuffer(), newIntBuffer()
+			for _, n := range inputs[i] {
+				in.WriteInt(n)
+			}
+			in.Close()
+			var m machine
+			if *local {
+				lm := newLocalMachine(prg, in, out)
+				lm.c.lenient = *lenient
+				m = lm
+			} else {
+				m = sup.newWorker(prg, in, out)
+			}
+			errs[i] = m.run()
+			outputs[i] = out.Drain()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, s := range sets {
+		out := make([]string, len(outputs[i]))
+		for j, n := range outputs[i] {
+			out[j] = fmt.Sprint(n)
+		}
+		fmt.Printf("[%s] %s", s, strings.Join(out, ","))
+		if errs[i] != nil {
+			fmt.Printf(" (%v)", errs[i])
+		}
+		fmt.Println()
+	}
+	fmt.Fprintf(os.Stderr, "%d runs in %v\n", len(sets), time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain runs the worker command instead of the tests when a supervisor
+// in one of them starts the test binary as a worker.
+func TestMain(m *testing.M) {
+	if os.Getenv("INTCODE_TEST_WORKER") != "" {
+		if err := testWorker(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testWorker runs the worker command. If INTCODE_TEST_CRASH names a file
+// that doesn't exist yet, it creates it and then crashes the first time
+// the program waits for input, by cutting the worker off after the start
+// frame.
+func testWorker() error {
+	crash := os.Getenv("INTCODE_TEST_CRASH")
+	if crash == "" {
+		return runWorker(nil)
+	}
+	if _, err := os.Stat(crash); err == nil {
+		return runWorker(nil)
+	}
+	if err := os.WriteFile(crash, nil, 0o644); err != nil {
+		return err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	t, payload, err := readFrame(bufio.NewReader(os.Stdin))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(pw)
+	if err := writeFrame(w, t, payload); err != nil {
+		return err
+	}
+	pw.Close()
+	os.Stdin = pr
+	return runWorker(nil)
+}
+
+// runInWorker runs prg with input in a worker process made from the test
+// binary.
+func runInWorker(t *testing.T, sup *supervisor, prg, input []int) ([]int, *worker, error) {
+	t.Helper()
+	t.Setenv("INTCODE_TEST_WORKER", "1")
+	in, out := newIntBuffer(), newIntBuffer()
+	for _, n := range input {
+		in.WriteInt(n)
+	}
+	in.Close()
+	w := sup.newWorker(prg, in, out)
+	err := w.run()
+	return out.Drain(), w, err
+}
+
+func testSupervisor(t *testing.T) *supervisor {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	return &supervisor{exe: exe, maxRestarts: defaultMaxRestarts}
+}
+
+func TestWorkerRestart(t *testing.T) {
+	t.Setenv("INTCODE_TEST_CRASH", filepath.Join(t.TempDir(), "crashed"))
+	// out 1, in, out what was read, halt
+	prg := []int{104, 1, 3, 9, 4, 9, 99, 0, 0, 0}
+	got, w, err := runInWorker(t, testSupervisor(t), prg, []int{5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.restarts != 1 {
+		t.Errorf("worker restarted %d times, want 1", w.restarts)
+	}
+	// The 1 output before the crash isn't repeated.
+	if !equalInts(got, []int{1, 5}) {
+		t.Errorf("output %v, want [1 5]", got)
+	}
+}
+
+func TestWorkerLenient(t *testing.T) {
+	// An output instruction with a mode for a parameter it doesn't have.
+	prg := []int{1104, 7, 99}
+	sup := testSupervisor(t)
+	if _, _, err := runInWorker(t, sup, prg, nil); err == nil {
+		t.Error("strict worker ran an instruction with too many modes")
+	}
+	sup.lenient = true
+	got, _, err := runInWorker(t, sup, prg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalInts(got, []int{7}) {
+		t.Errorf("lenient worker output %v, want [7]", got)
+	}
+}